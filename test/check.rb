@@ -7,9 +7,12 @@ require 'ostruct'
 require 'pp'
 require 'mkmf'
 require 'ptools'
+require 'open3'
+require 'tmpdir'
 
 $commands = {"compile" => "compile", "error" => "error", "run" => "run"}
 $zebu = nil
+$flags = ""
 
 def get_command(line) 
   toks = line.split
@@ -17,12 +20,18 @@ def get_command(line)
     puts "error: unexpected command %s" % toks[1]
     exit 1
   end 
+  # anything after the command is passed to zebu
+  $flags = toks[2..-1].join(" ")
   return toks[1]
 end
 
+# the generated code is written to a temporary directory, only the
+# diagnostics are checked
 def compile_file(name) 
-  output = `#{$zebu} #{name}`
-  return output, $?.exitstatus
+  Dir.mktmpdir do |dir|
+    output = `#{$zebu} #{$flags} -o #{dir}/zb.go #{name}`
+    return output, $?.exitstatus
+  end
 end
 
 # compile command is simple: must return no output
@@ -42,6 +51,8 @@ end
 def parse_output(output)
   errors = {}
   output.lines do |line|
+		# skip the quoted source lines and the notes that follow an error
+		next if line =~ /^\s/ || line.include?(": note: ")
 		ln = line.split(":")[1].to_i
 		if errors[ln].nil?
 			errors[ln] = [line.strip]
@@ -99,11 +110,96 @@ def do_error_command(name, file)
   end
 end
 
-def do_run_command(name, file)
-  puts "error: run not yet implemented"
+# run command builds the generated parser and runs it on the inputs
+# listed in the grammar:
+#
+#   // INPUT "1 + 2"
+#   // OUTPUT 3
+#
+# The OUTPUT lines after an INPUT are what parsing it must print: the
+# value of the start rule, or ok when it has no type, or one line
+# "error: ..." for each syntax error. Without a -backend flag the parser
+# of every backend is run. zebu/run_test.go runs the same grammars.
+$backends = ["rd", "table", "lalr", "earley"]
+
+$driver = <<-'EOS'
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	%s
+	if l, ok := err.(ZbErrorList); ok {
+		for _, e := range l {
+			fmt.Println("error:", e)
+		}
+	} else if err != nil {
+		fmt.Println("error:", err)
+	}
+}
+EOS
+
+def run_cases(file)
+  cases = []
+  file.each do |line|
+    line = line.chomp
+    if line.start_with?("// INPUT ")
+      cases << [line.sub("// INPUT ", "").undump, []]
+    elsif line.start_with?("// OUTPUT ") && cases.length > 0
+      cases[-1][1] << line.sub("// OUTPUT ", "")
+    end
+  end
+  return cases
+end
+
+def run_bug(name, backend, what, output)
+  puts "----------------------------------------------------------------------"
+  puts "BUG: %s -backend=%s %s" % [name, backend, what]
+  puts "----------------------------------------------------------------------"
+  puts output
+  puts "----------------------------------------------------------------------"
   exit 1
 end
 
+def do_run_command(name, file)
+  cases = run_cases(file)
+  backends = $flags.scan(/-backend[= ](\S+)/).flatten
+  flags = $flags.gsub(/-backend[= ]\S+/, "")
+  backends = $backends if backends.empty?
+  backends.each do |backend|
+    Dir.mktmpdir do |dir|
+      output = `#{$zebu} #{flags} -backend=#{backend} -o #{dir}/zb.go #{name}`
+      if (output != "" || $?.exitstatus != 0)
+        run_bug(name, backend, "failed to compile", output)
+      end
+      code = File.read("#{dir}/zb.go").sub(/^package \w+$/, "package main")
+      call = "result, err := Parse(strings.NewReader(os.Args[1]))\nif err == nil {\nfmt.Println(result)\n}"
+      if code.include?("func Parse(r io.Reader) (err error)")
+        call = "err := Parse(strings.NewReader(os.Args[1]))\nif err == nil {\nfmt.Println(\"ok\")\n}"
+      end
+      File.write("#{dir}/zb.go", code)
+      File.write("#{dir}/main.go", $driver.sub("%s", call))
+      File.write("#{dir}/go.mod", "module zbrun\n\ngo 1.21\n")
+
+      env = {"GO111MODULE" => "on", "GOFLAGS" => "", "GOTOOLCHAIN" => "local"}
+      output, status = Open3.capture2e(env, "go", "build", "-o", "zbrun", ".", :chdir => dir)
+      run_bug(name, backend, "generated parser failed to build", output) unless status.success?
+
+      cases.each do |input, want|
+        output, status = Open3.capture2e("#{dir}/zbrun", input)
+        got = output.chomp
+        if !status.success? || got != want.join("\n")
+          run_bug(name, backend, "on input %s" % input.dump, "got:\n#{got}\nwant:\n#{want.join("\n")}")
+        end
+      end
+    end
+  end
+end
+
 options = OpenStruct.new
 options.encoding = "utf8"
 options.verbose = false
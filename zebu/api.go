@@ -0,0 +1,166 @@
+// api.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"io/fs"
+)
+
+// Options control a compilation by Compile. The zero value compiles a
+// recursive descent parser with every lint check enabled.
+type Options struct {
+	// Backend is the kind of parser to generate: rd (recursive
+	// descent, the default), table, lalr or earley. The rd, table
+	// and lalr parsers recover from syntax errors, skipping input up
+	// to a token that can follow what they were parsing or past a
+	// token of a sync declaration, and return all the errors they
+	// find; earley parsers stop at the first one.
+	Backend string
+
+	// Includes are the directories searched for imported grammars,
+	// after the directory of the grammar itself.
+	Includes []string
+
+	// Checks turns lint checks on or off by name, like -W. The checks
+	// missing from it are on.
+	Checks map[string]bool
+
+	// Werror reports the findings of the lint checks as errors.
+	Werror bool
+
+	// FS is the file system grammars are read from, such as an
+	// embed.FS. Without it they are read from the files of the OS.
+	FS fs.FS
+}
+
+// Result is the outcome of Compile.
+type Result struct {
+	// Diagnostics are the errors and warnings, in the order of their
+	// positions.
+	Diagnostics []Diagnostic
+
+	// Code is the generated Go source, nil when the grammar has errors.
+	Code []byte
+
+	// Grammar is the grammar as written, nil when it could not be
+	// parsed.
+	Grammar *Grammar
+
+	// Transformed is the grammar after the LL(1) transformations of the
+	// rd and table backends, nil when they failed. The other backends
+	// take the grammar as written, and Transformed is Grammar.
+	Transformed *Grammar
+}
+
+// Diagnostic is an error or a warning about a grammar.
+type Diagnostic struct {
+	Severity string // error or warning
+	Code     string // stable code, such as ZB0201
+	Message  string
+	Pos      token.Position // start of the offending source
+	End      token.Position // first position after it
+
+	// Related are other locations involved, such as a previous
+	// definition, with a message about each.
+	Related []Diagnostic
+}
+
+// String formats d as the zebu command prints it. A diagnostic about the
+// grammar as a whole, such as a file that could not be opened, has no
+// position to print.
+func (d Diagnostic) String() string {
+	msg := d.Message
+	if d.Severity == "warning" {
+		msg = "warning: " + msg
+	}
+	if !d.Pos.IsValid() {
+		return msg
+	}
+	return fmt.Sprintf("%s: %s", d.Pos, msg)
+}
+
+// Compile lets programs embed zebu instead of running the zebu command.
+// It reports what the command would print as Diagnostics and returns the
+// generated parser instead of writing it to a file.
+//
+// Compile compiles the grammar read from src, or from the file filename
+// when src is nil. The grammar is known as filename in diagnostics, and
+// its imports are searched for next to it.
+// Compile returns an error describing the first error of the grammar
+// when it has any, along with a Result holding all of them.
+func Compile(src io.Reader, filename string, opts Options) (*Result, error) {
+	if opts.Backend == "" {
+		opts.Backend = "rd"
+	}
+	switch opts.Backend {
+	case "rd", "table", "lalr", "earley":
+	default:
+		return nil, fmt.Errorf("unknown backend %s", opts.Backend)
+	}
+	checks := make(map[string]bool)
+	for check := range lintChecks {
+		checks[check] = true
+	}
+	for check, on := range opts.Checks {
+		if _, ok := checks[check]; !ok {
+			return nil, fmt.Errorf("unknown check %s", check)
+		}
+		checks[check] = on
+	}
+	c := consCompiler(opts.Backend, opts.Includes, checks, opts.Werror)
+	c.fsys = opts.FS
+
+	res := new(Result)
+	top := c.compile(filename, src, res)
+	if top != nil {
+		res.Code = c.generate(top)
+	}
+	// Code generation has warnings of its own
+	for _, ce := range c.sortedErrors() {
+		res.Diagnostics = append(res.Diagnostics, c.diagnostic(ce))
+	}
+	if top == nil {
+		for _, d := range res.Diagnostics {
+			if d.Severity == "error" {
+				return res, fmt.Errorf("%s", d)
+			}
+		}
+		return res, fmt.Errorf("%s: compilation failed", filename)
+	}
+	return res, nil
+}
+
+func (c *compiler) diagnostic(ce *CCError) Diagnostic {
+	d := Diagnostic{
+		Severity: diagSeverity(ce),
+		Code:     diagCode(ce),
+		Message:  ce.msg,
+		Pos:      tokenPos(ce.pos),
+		End:      c.tokenEnd(ce.pos),
+	}
+	for _, r := range ce.related {
+		d.Related = append(d.Related, c.diagnostic(r))
+	}
+	return d
+}
+
+// tokenPos returns the start of p as a go/token position.
+func tokenPos(p *Position) token.Position {
+	if p == nil {
+		return token.Position{}
+	}
+	return token.Position{Filename: p.file, Offset: p.off, Line: p.line, Column: p.col}
+}
+
+// tokenEnd returns the end of p as a go/token position.
+func (c *compiler) tokenEnd(p *Position) token.Position {
+	if p == nil {
+		return token.Position{}
+	}
+	line, col := c.endPos(p)
+	return token.Position{Filename: p.file, Offset: p.end, Line: line, Column: col}
+}
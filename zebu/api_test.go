@@ -0,0 +1,172 @@
+// api_test.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Compilations share no state, so compiling the grammars of the test
+// directory all at once must give what compiling them one by one does.
+
+func TestCompileConcurrent(t *testing.T) {
+	files, _ := filepath.Glob("../test/*.zb")
+	type compilation struct {
+		backend, file string
+		code          []byte
+		diags         []Diagnostic
+	}
+	var l []compilation
+	for _, backend := range []string{"rd", "table", "lalr", "earley"} {
+		for _, file := range files {
+			res, _ := Compile(nil, file, Options{Backend: backend})
+			l = append(l, compilation{backend, file, res.Code, res.Diagnostics})
+		}
+	}
+
+	for _, want := range l {
+		want := want
+		t.Run(want.backend+"/"+filepath.Base(want.file), func(t *testing.T) {
+			t.Parallel()
+			res, _ := Compile(nil, want.file, Options{Backend: want.backend})
+			if !bytes.Equal(res.Code, want.code) {
+				t.Errorf("code differs from the code of a compilation on its own")
+			}
+			if !reflect.DeepEqual(res.Diagnostics, want.diags) {
+				t.Errorf("diagnostics %v, want %v", res.Diagnostics, want.diags)
+			}
+		})
+	}
+}
+
+func TestCompileMissingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "missing.zb")
+	_, err := Compile(nil, file, Options{})
+	if want := "could not open " + file + "."; err == nil || err.Error() != want {
+		t.Errorf("error %v, want %s", err, want)
+	}
+}
+
+// Grammars and their imports are read from Options.FS when it is set,
+// with the paths of the grammars on disk giving the same parser.
+func TestCompileFS(t *testing.T) {
+	fsys := make(fstest.MapFS)
+	for _, file := range []string{"import1.zb", "common/lexical.zb"} {
+		data, err := os.ReadFile(filepath.Join("../test", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys["grammars/"+file] = &fstest.MapFile{Data: data}
+	}
+	want, err := Compile(nil, "../test/import1.zb", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Compile(nil, "grammars/import1.zb", Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Code, want.Code) {
+		t.Errorf("code differs from the code of the grammar on disk")
+	}
+
+	delete(fsys, "grammars/common/lexical.zb")
+	_, err = Compile(nil, "grammars/import1.zb", Options{FS: fsys})
+	if want := "grammars/import1.zb:8:1: cannot find imported grammar 'common/lexical.zb'."; err == nil || err.Error() != want {
+		t.Errorf("error %v, want %s", err, want)
+	}
+}
+
+// modelRule is what TestCompileModel checks of a rule of a model.
+type modelRule struct {
+	origin        string
+	prods         int
+	nullable      bool
+	first, follow string
+}
+
+// The rules of test/ll_arith.zb as written, and after the left recursion
+// of expr and term is removed.
+var llArithModel = map[string]modelRule{
+	"start":  {"", 1, false, "'(' INTEGER", ""},
+	"expr":   {"", 3, false, "'(' INTEGER", "')' '+' '-'"},
+	"term":   {"", 3, false, "'(' INTEGER", "')' '*' '+' '-' '/'"},
+	"factor": {"", 2, false, "'(' INTEGER", "')' '*' '+' '-' '/'"},
+}
+
+var llArithTransformed = map[string]modelRule{
+	"start":  {"", 1, false, "'(' INTEGER", ""},
+	"expr":   {"", 1, false, "'(' INTEGER", "')'"},
+	"term":   {"", 1, false, "'(' INTEGER", "')' '+' '-'"},
+	"factor": {"", 2, false, "'(' INTEGER", "')' '*' '+' '-' '/'"},
+	"expr'":  {"expr", 2, false, "'+' '-'", "')' '+' '-'"},
+	"expr''": {"expr", 2, true, "'+' '-'", "')'"},
+	"term'":  {"term", 2, false, "'*' '/'", "')' '*' '+' '-' '/'"},
+	"term''": {"term", 2, true, "'*' '/'", "')' '+' '-'"},
+}
+
+func TestCompileModel(t *testing.T) {
+	res, err := Compile(nil, "../test/ll_arith.zb", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		what  string
+		g     *Grammar
+		rules map[string]modelRule
+	}{
+		{"Grammar", res.Grammar, llArithModel},
+		{"Transformed", res.Transformed, llArithTransformed},
+	} {
+		if tc.g.Name != "ll_arith" || tc.g.Start == nil || tc.g.Start.Name != "start" {
+			t.Errorf("%s: grammar %s starting at %v, want ll_arith starting at start", tc.what, tc.g.Name, tc.g.Start)
+		}
+		if len(tc.g.Rules) != len(tc.rules) {
+			t.Errorf("%s: %d rules, want %d", tc.what, len(tc.g.Rules), len(tc.rules))
+		}
+		for _, r := range tc.g.Rules {
+			want, ok := tc.rules[r.Name]
+			if !ok {
+				t.Errorf("%s: unexpected rule %s", tc.what, r.Name)
+				continue
+			}
+			got := modelRule{r.Origin, len(r.Productions), r.Nullable, strings.Join(r.First, " "), strings.Join(r.Follow, " ")}
+			if got != want {
+				t.Errorf("%s: rule %s is %+v, want %+v", tc.what, r.Name, got, want)
+			}
+		}
+	}
+
+	// The rules of the elements are the rules of the grammar
+	rules := make(map[*Rule]bool)
+	for _, r := range res.Transformed.Rules {
+		rules[r] = true
+	}
+	for _, r := range res.Transformed.Rules {
+		for _, p := range r.Productions {
+			for _, e := range p.Elements {
+				if e.Kind == ElemRule && !rules[e.Rule] {
+					t.Errorf("rule %s refers to %s, which is not a rule of the grammar", r.Name, e.Rule.Name)
+				}
+			}
+		}
+	}
+}
+
+// The warnings of code generation are diagnostics too.
+func TestCompileGenerateWarning(t *testing.T) {
+	res, err := Compile(nil, "../test/bad_sync_earley.zb", Options{Backend: "earley"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Code != "ZB0310" {
+		t.Errorf("diagnostics %v, want the warning ZB0310", res.Diagnostics)
+	}
+}
@@ -6,20 +6,25 @@ package zebu
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"go/ast"
 	"go/format"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 )
 
 type Strlit struct {
 	lit  string
 	link *Strlit
 	defn *Node
-	gram *Grammar
+	gram *grammarFile
 }
 
 func (s *Strlit) String() string {
@@ -37,7 +42,7 @@ func (t StrlitTab) lookup(s string) *Strlit {
 	return t.lookupGrammar(s, localGrammar)
 }
 
-func (t StrlitTab) lookupGrammar(s string, g *Grammar) (lit *Strlit) {
+func (t StrlitTab) lookupGrammar(s string, g *grammarFile) (lit *Strlit) {
 	for h := t[s]; h != nil; h = h.link {
 		if h.lit == s && h.gram == g {
 			return h
@@ -68,9 +73,10 @@ type Sym struct {
 	name string
 	link *Sym
 	pos  *Position // always points to last position for this sym
-	gram *Grammar
+	gram *grammarFile
 	defn *Node
 	defv bool
+	dead bool // definition removed by delete
 
 	lexical TokenKind // lexical kind associated with this sym
 }
@@ -86,6 +92,7 @@ var syms = []struct {
 	{"grammar", GRAMMAR},
 	{"import", IMPORT},
 	{"keyword", KEYWORD},
+	{"sync", SYNC},
 	{"extend", EXTEND},
 	{"inherit", INHERIT},
 	{"override", OVERRIDE},
@@ -106,7 +113,7 @@ func (t SymTab) lookup(s string) *Sym {
 	return t.lookupGrammar(s, localGrammar)
 }
 
-func (t SymTab) lookupGrammar(s string, g *Grammar) (sym *Sym) {
+func (t SymTab) lookupGrammar(s string, g *grammarFile) (sym *Sym) {
 	for h := t[s]; h != nil; h = h.link {
 		if h.name == s && h.gram == g {
 			return h
@@ -151,48 +158,130 @@ func consTypeTab() (t TypeTab) {
 	return
 }
 
-type Grammar struct {
-	name string
+// grammarFile is the namespace of the rules and regdefs declared in one file.
+// Keywords, string literals and variable ids live in localGrammar, which
+// every file shares.
+type grammarFile struct {
+	name     string
+	file     string
+	pos      *Position // import declaration that loaded the file
+	top      *Node
+	imports  []*grammarFile
+	imported bool // loaded through an import rather than named on the command line
+	base     bool // parsed into the namespace of the grammar extending it
+	loading  bool // still being parsed, importing it again is a cycle
 }
 
-func consGrammar(s string) (g *Grammar) {
-	g = &Grammar{
+func consGrammar(s string) (g *grammarFile) {
+	g = &grammarFile{
 		name: s,
 	}
 	return
 }
 
-func (g *Grammar) String() string {
-	return g.name
+// lookupImport finds the definition of s in the grammars imported by the
+// grammar declaring s. Imports are not transitive: a grammar only sees
+// what it imports itself.
+func (c *compiler) lookupImport(s *Sym) (n *Node) {
+	if s.gram == nil {
+		return
+	}
+	for _, g := range s.gram.imports {
+		s1 := c.symbols.lookupGrammar(s.name, g)
+		if s1.defn == nil || s1.defn.op == ONONAME {
+			continue
+		}
+		if n != nil && n != s1.defn {
+			c.compileError(s.pos, "%s is defined by both %s and %s.", s, n.sym.gram, g).
+				relate(n.pos, "definition in "+n.sym.gram.name).
+				relate(s1.defn.pos, "definition in "+g.name)
+			return
+		}
+		n = s1.defn
+	}
+	return
 }
 
-// Compiler globals
-var zbparser *Parser
-var localGrammar *Grammar
-var symbols SymTab
-var types TypeTab
-var strlits StrlitTab
-var varids []*Sym
-var nextvarid int
-var nextaction int
-var opt [256]bool
-var currule *Node
-var curgram *Node
+// pathList is a flag collecting every -I directory in order.
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, string(filepath.ListSeparator))
+}
 
-var errors []*CCError
-var numSavedErrs int
-var numTotalErrs int
+func (l *pathList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
 
-var zbpos *Position
-var first map[*Node]map[*Node]bool
-var follow map[*Node]map[*Node]bool
+func (g *grammarFile) String() string {
+	return g.name
+}
 
+// compiler holds the state of one compilation. Compilations share
+// nothing, so any number of them can run at once.
+type compiler struct {
+	// Options
+	backend  string
+	includes []string
+	checks   map[string]bool // lint checks enabled
+	werror   bool
+	fsys     fs.FS // where grammars are read from, nil for the OS
+
+	// Parsing
+	parser     *Parser
+	grammars   []*grammarFile
+	symbols    SymTab
+	types      TypeTab
+	strlits    StrlitTab
+	varids     []*Sym
+	nextvarid  int
+	nextaction int
+	currule    *Node
+	curgram    *Node
+	sources    map[string]*bytes.Buffer // text of the grammars read
+
+	// Diagnostics
+	errors       []*CCError
+	numSavedErrs int
+	numTotalErrs int
+	zbpos        *Position
+	diagout      io.Writer // where flushErrors writes
+	diagfmt      string    // how flushErrors writes: text, json or sarif
+
+	// Analysis and code generation
+	first     map[*Node]map[*Node]bool
+	follow    map[*Node]map[*Node]bool
+	lexdfa    *DFA
+	lalrtab   *LALR
+	earleytab *LALR
+	dclids    map[*Node]int
+	needs     map[*Node][]*Node
+	accrules  map[*Node]*Node
+	synctoks  []*Node  // tokens error recovery stops at
+	imports   []string // packages the generated code imports
+	codeout   *bufio.Writer
+}
+
+// localGrammar is the namespace of keywords, string literals and
+// variable ids. It only tells symbols apart, so every compilation can
+// share it.
+var localGrammar = consGrammar("_")
+
+// Command line flags
+var opt [256]bool
 var outflag string
-var codeout *bufio.Writer
+var diagflag string
+var backendflag string
+var includeflag pathList
+var werrorflag bool
 
 type CCError struct {
-	pos *Position
-	msg string
+	pos     *Position
+	msg     string
+	format  string // msg before formatting, which identifies the diagnostic
+	warn    bool
+	related []*CCError
 }
 
 func (ce *CCError) Error() string {
@@ -201,11 +290,18 @@ func (ce *CCError) Error() string {
 
 func consCCError(p *Position, msg string, args ...interface{}) *CCError {
 	return &CCError{
-		pos: p,
-		msg: fmt.Sprintf(msg, args...),
+		pos:    p,
+		msg:    fmt.Sprintf(msg, args...),
+		format: msg,
 	}
 }
 
+// relate adds a location related to ce, such as a previous definition.
+func (ce *CCError) relate(p *Position, msg string) *CCError {
+	ce.related = append(ce.related, &CCError{pos: p, msg: msg})
+	return ce
+}
+
 type CCErrorByPos []*CCError
 
 func (a CCErrorByPos) Len() int {
@@ -217,64 +313,123 @@ func (a CCErrorByPos) Swap(i, j int) {
 }
 
 func (a CCErrorByPos) Less(i, j int) bool {
-	// TODO : Need a stronger possitioning (sort by order encountered, then by pos inside a file)
 	ie, je := a[i].pos, a[j].pos
+	if ie == nil || je == nil {
+		return ie == nil && je != nil
+	}
+	if ie.file != je.file {
+		return ie.file < je.file
+	}
 	if ie.line == je.line {
 		return ie.col < je.col
 	}
 	return ie.line < je.line
 }
 
-func compileError(p *Position, msg string, args ...interface{}) (ce *CCError) {
+func (c *compiler) compileError(p *Position, msg string, args ...interface{}) (ce *CCError) {
+	ce = consCCError(p, msg, args...)
+	c.errors = append(c.errors, ce)
+	c.numSavedErrs++
+	c.numTotalErrs++
+	return
+}
+
+// compileWarning reports a problem that does not stop compilation.
+func (c *compiler) compileWarning(p *Position, msg string, args ...interface{}) (ce *CCError) {
 	ce = consCCError(p, msg, args...)
-	errors = append(errors, ce)
-	numSavedErrs++
-	numTotalErrs++
+	ce.warn = true
+	c.errors = append(c.errors, ce)
 	return
 }
 
-func reerror(p *Position, re *CCError) (ce *CCError) {
+func (c *compiler) reerror(p *Position, re *CCError) (ce *CCError) {
 	ce = &CCError{
-		pos: p,
-		msg: re.msg,
-	}
-	errors = append(errors, ce)
-	numSavedErrs++
-	numTotalErrs++
+		pos:     p,
+		msg:     re.msg,
+		format:  re.format,
+		related: re.related,
+	}
+	c.errors = append(c.errors, ce)
+	c.numSavedErrs++
+	c.numTotalErrs++
 	return
 }
 
-func flushErrors() {
-	sort.Sort(CCErrorByPos(errors))
-	for i := 0; i < len(errors); i++ {
-		fmt.Printf("%s: %s\n", errors[i].pos, errors[i].msg)
+// sortedErrors returns the errors reported so far in the order of their
+// positions, without duplicates.
+func (c *compiler) sortedErrors() []*CCError {
+	sort.Sort(CCErrorByPos(c.errors))
+	errs := make([]*CCError, 0, len(c.errors))
+	for i := 0; i < len(c.errors); i++ {
+		if i > 0 && c.errors[i].pos == c.errors[i-1].pos && c.errors[i].msg == c.errors[i-1].msg {
+			continue
+		}
+		errs = append(errs, c.errors[i])
 	}
+	return errs
 }
 
-func init() {
-	localGrammar = consGrammar("_")
-	symbols = consSymTab()
-	types = consTypeTab()
-	strlits = consStrlitTab()
-	errors = make([]*CCError, 0, 10)
-	zbparser = consParser()
-	first = make(map[*Node]map[*Node]bool)
-	follow = make(map[*Node]map[*Node]bool)
-	varids = make([]*Sym, 0, 0)
+func (c *compiler) flushErrors() {
+	errs := c.sortedErrors()
+	switch c.diagfmt {
+	case "json":
+		c.jsonDump(errs)
+		return
+	case "sarif":
+		c.sarifDump(errs)
+		return
+	}
+	c.textDump(errs)
+}
 
+// setFlags defines the command line flags of Main. Programs using
+// Compile keep their flag set to themselves.
+func setFlags() {
 	flag.BoolVar(&opt['D'], "D", false, "turn on debug messages")
 	flag.BoolVar(&opt['h'], "h", false, "print this help message")
 	flag.BoolVar(&opt['0'], "d0", false, "dump the AST after parsing")
 	flag.BoolVar(&opt['1'], "d1", false, "dump the AST after transformation")
 	flag.BoolVar(&opt['p'], "p", false, "pretty print the AST after transformation")
 	flag.BoolVar(&opt['g'], "g", false, "print semantic information about grammar construction")
-	flag.StringVar(&outflag, "o", "", "generated output file")
+	flag.StringVar(&outflag, "o", "", "generated output file, - for the standard output (default zb.go)")
+	flag.StringVar(&backendflag, "backend", "rd", "parser to generate: rd (recursive descent), table (table driven LL(1)), lalr (LALR(1)) or earley (Earley, for ambiguous grammars)")
+	flag.StringVar(&diagflag, "diagnostics", "text", "format of diagnostics: text, json or sarif")
+	flag.Var(&includeflag, "I", "add a directory to search for imported grammars")
+	flag.Var(lintFlag{}, "W", "enable a lint check, or disable it with no-check: unused-regdef, unreachable, unproductive, unused-varid or all")
+	flag.BoolVar(&werrorflag, "Werror", false, "treat lint warnings as errors")
+}
+
+// consCompiler returns a compiler with the given options and empty
+// tables.
+func consCompiler(backend string, includes []string, checks map[string]bool, werror bool) *compiler {
+	c := &compiler{
+		backend:  backend,
+		includes: includes,
+		checks:   checks,
+		werror:   werror,
+		symbols:  consSymTab(),
+		types:    consTypeTab(),
+		strlits:  consStrlitTab(),
+		varids:   make([]*Sym, 0, 0),
+		sources:  make(map[string]*bytes.Buffer),
+		errors:   make([]*CCError, 0, 10),
+		diagout:  os.Stdout,
+		diagfmt:  "text",
+		first:    make(map[*Node]map[*Node]bool),
+		follow:   make(map[*Node]map[*Node]bool),
+		dclids:   make(map[*Node]int),
+		needs:    make(map[*Node][]*Node),
+		accrules: make(map[*Node]*Node),
+		imports:  []string{"bufio", "bytes", "fmt", "go/token", "io", "sort", "strings", "unicode/utf8"},
+	}
+	c.parser = consParser(c)
 
 	// Populate symbol table with known symbols
 	for i := 0; i < len(syms); i++ {
-		s := symbols.lookup(syms[i].name)
+		s := c.symbols.lookup(syms[i].name)
 		s.lexical = syms[i].kind
 	}
+	return c
 }
 
 // Stuff related to dcls, here for now
@@ -298,10 +453,10 @@ func newname(s *Sym) *Node {
 	}
 }
 
-func oldname(s *Sym) (n *Node) {
+func (c *compiler) oldname(s *Sym) (n *Node) {
 	if s.defn == nil {
 		n = newname(s)
-		declare(n)
+		c.declare(n)
 		return
 	}
 	n = s.defn
@@ -309,107 +464,163 @@ func oldname(s *Sym) (n *Node) {
 }
 
 // TODO : Check for position
-func declare(n *Node) {
+func (c *compiler) declare(n *Node) {
 	s := n.sym
 	if s.defn != nil && s.defn.op != ONONAME {
-		compileError(s.pos, "%s previously defined at %s.", s, s.defn.pos)
+		c.compileError(s.pos, "%s previously defined at %s.", s, s.defn.pos).relate(s.defn.pos, "previous definition")
 		return
 	}
 	s.defn = n
 	return
 }
 
-func resolve(n *Node) *Node {
+func (c *compiler) resolve(n *Node) *Node {
 	if n.op != ONONAME {
 		return n
 	}
 	s := n.sym
 	if s.defn == nil || s.defn.op == ONONAME {
+		if n1 := c.lookupImport(s); n1 != nil {
+			return n1
+		}
+		if s.dead {
+			c.compileError(s.pos, "%s is deleted but still used.", s)
+			return nil
+		}
 		if s.lexical == TERMINAL {
-			compileError(s.pos, "unresolved terminal symbol %s.", s)
+			c.compileError(s.pos, "unresolved terminal symbol %s.", s)
 		} else {
-			compileError(s.pos, "unresolved nonterminal symbol %s.", s)
+			c.compileError(s.pos, "unresolved nonterminal symbol %s.", s)
 		}
 		return nil
 	}
 	return s.defn
 }
 
-func pushvarid(s *Sym) (err error) {
-	varids = append(varids, s)
+func (c *compiler) pushvarid(s *Sym) (err error) {
+	c.varids = append(c.varids, s)
 	return
 }
 
-func pushnextvarid() (s *Sym) {
-	s = symbols.lookup(fmt.Sprintf("$%d", nextvarid))
-	s.pos = zbpos
-	pushvarid(s)
+func (c *compiler) pushnextvarid() (s *Sym) {
+	s = c.symbols.lookup(fmt.Sprintf("$%d", c.nextvarid))
+	s.pos = c.zbpos
+	c.pushvarid(s)
 	return
 }
 
-func popvarids() {
-	for _, s := range varids {
+func (c *compiler) popvarids() {
+	for _, s := range c.varids {
 		s.defn = nil
 	}
-	varids = varids[:0]
+	c.varids = c.varids[:0]
 }
 
 // This is for development purpose only, to take my mind off resolution
 // so I can focus on semantic analysis. This resolution has a cost of
 // O(n) in the size of the AST, which can be done inside one of the
 // other O(n) passes.
-func resolveSymbols(n *Node) *Node {
-	numSavedErrs = 0
-	return walkResolve(n)
+func (c *compiler) resolveSymbols(n *Node) *Node {
+	c.numSavedErrs = 0
+	for _, g := range c.grammars {
+		if g.top != n {
+			c.walkResolve(g.top)
+		}
+	}
+	n = c.walkResolve(n)
+	c.mergeImports(n)
+	return n
+}
+
+// mergeImports adds the declarations of imported grammars to top, so the
+// later passes see one grammar. Only keywords and the declarations
+// reachable from top are added; the rest of an imported grammar does not
+// affect the lexer or the generated parser. So are the skipped and hidden
+// regdefs, which no rule refers to but the lexer still matches.
+func (c *compiler) mergeImports(top *Node) {
+	reach := make(map[*Node]bool)
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n == nil {
+			return
+		}
+		switch n.op {
+		case ORULE, OREGDEF:
+			if reach[n] {
+				return
+			}
+			reach[n] = true
+		}
+		walk(n.left)
+		walk(n.right)
+		for _, n1 := range n.nodes {
+			walk(n1)
+		}
+	}
+	for _, n := range top.nodes {
+		walk(n)
+	}
+
+	for _, g := range c.grammars {
+		if g.top == nil || g.top == top {
+			continue
+		}
+		for _, n := range g.top.nodes {
+			if reach[n] || n.op == OKEYWORD || n.op == OSYNC || n.op == OREGDEF && hiddenBy(n) != "" {
+				top.nodes = append(top.nodes, n)
+			}
+		}
+	}
 }
 
-func walkResolve(n *Node) *Node {
-	if n == nil || (n.op != ONONAME && n.resolve) {
+func (c *compiler) walkResolve(n *Node) *Node {
+	// nepsilon is shared by every compilation, and has nothing to resolve
+	if n == nil || n == nepsilon || (n.op != ONONAME && n.resolve) {
 		return n
 	}
 	n.resolve = true
 	switch n.op {
 	case ONONAME:
-		return resolve(n)
+		return c.resolve(n)
 	case OGRAM:
 		for i := 0; i < len(n.nodes); i++ {
-			n.nodes[i] = walkResolve(n.nodes[i])
+			n.nodes[i] = c.walkResolve(n.nodes[i])
 		}
 	case ORULE:
 		for i := 0; i < len(n.nodes); i++ {
 			for j := 0; j < len(n.nodes[i].nodes); j++ {
 				// TODO : Might want to remove the extra lookups
-				n.nodes[i].nodes[j].left = walkResolve(n.nodes[i].nodes[j].left)
+				n.nodes[i].nodes[j].left = c.walkResolve(n.nodes[i].nodes[j].left)
+				if e := n.nodes[i].nodes[j].left; e != nil && e.op == OGRAM {
+					c.compileError(n.nodes[i].pos, "%s is the grammar name, not a rule.", e.sym)
+					n.nodes[i].nodes[j].left = nil
+					continue
+				}
+				// The parser never gets the tokens of skipped and hidden regdefs
+				if e := n.nodes[i].nodes[j].left; e != nil && e.op == OREGDEF && hiddenBy(e) != "" {
+					what := "hidden"
+					if hiddenBy(e) == "skip" {
+						what = "skipped"
+					}
+					c.compileError(n.nodes[i].pos, "regular definition %s is %s and never reaches the parser.", e.sym, what)
+				}
 			}
 		}
 	case OREGDEF:
-		n.left = walkResolve(n.left)
+		n.left = c.walkResolve(n.left)
+	case OSYNC:
+		for i := 0; i < len(n.nodes); i++ {
+			n.nodes[i] = c.walkResolve(n.nodes[i])
+		}
 	case OALT, OCAT, OKLEENE, OPLUS, OREPEAT:
-		n.left = walkResolve(n.left)
-		n.right = walkResolve(n.right)
+		n.left = c.walkResolve(n.left)
+		n.right = c.walkResolve(n.right)
 	}
 	return n
 }
 
-func gofmt() {
-	src, err := ioutil.ReadFile(outflag)
-	if err != nil {
-		return
-	}
-	src, err = format.Source(src)
-	if err != nil {
-		return
-	}
-	ioutil.WriteFile(outflag, src, 0666)
-}
-
-func exit(status int) {
-	flushErrors()
-	if codeout != nil {
-		codeout.Flush()
-		codeout = nil
-		gofmt()
-	}
+func (c *compiler) exit(status int) {
+	c.flushErrors()
 	os.Exit(status)
 }
 
@@ -420,6 +631,7 @@ func dbg(msg string, args ...interface{}) {
 }
 
 func Main() {
+	setFlags()
 	flag.Parse()
 	args := flag.Args()
 
@@ -431,56 +643,128 @@ func Main() {
 	if outflag == "" {
 		outflag = "zb.go"
 	}
-	file, _ := os.Create(outflag)
-	if file == nil {
-		fmt.Printf("failed to created file %s\n", outflag)
-		exit(1)
+
+	c := consCompiler(backendflag, includeflag, lintChecks, werrorflag)
+	if outflag == "-" {
+		// Keep the generated code apart from the diagnostics
+		c.diagout = os.Stderr
+	}
+	switch diagflag {
+	case "text", "json", "sarif":
+		c.diagfmt = diagflag
+	default:
+		c.compileError(nil, "unknown diagnostics format %s.", diagflag)
+		c.exit(2)
+	}
+	switch c.backend {
+	case "rd", "table", "lalr", "earley":
+	default:
+		c.compileError(nil, "unknown backend %s.", c.backend)
+		c.exit(2)
+	}
+
+	// The grammar - is read from the standard input
+	name, src := args[0], io.Reader(nil)
+	if name == "-" {
+		name, src = "<stdin>", os.Stdin
+	}
+	top := c.compile(name, src, nil)
+	if top == nil {
+		c.exit(1)
+	}
+
+	// Pass #4: Dump out the generated code, to the standard output for
+	// -o -
+	code := c.generate(top)
+	dbg("Finished Pass #4\n")
+	if outflag == "-" {
+		os.Stdout.Write(code)
+	} else if err := ioutil.WriteFile(outflag, code, 0666); err != nil {
+		c.compileError(nil, "failed to create file %s.", outflag)
+		c.exit(1)
 	}
-	codeout = bufio.NewWriter(file)
 
+	dbg("Compilation finished\n")
+	c.exit(0)
+}
+
+// compile runs the passes up to code generation on the grammar named
+// name, read from src or from the file name when src is nil. It returns
+// the grammar ready for codeDump, or nil after errors. When res is not
+// nil the models of the grammar are set in it.
+func (c *compiler) compile(name string, src io.Reader, res *Result) *Node {
 	dbg("Starting compilation\n")
 
 	// Pass #1: Parse grammar (dependencies must be in include path)
-	name := args[0]
-	top := zbparser.parse(name)
-	if numTotalErrs > 0 {
-		exit(1)
+	top := c.parser.parse(name, src)
+	if c.numTotalErrs > 0 {
+		return nil
 	}
 	dbg("Finished Pass #1\n")
 
 	// Pass #1.5: Resolve symbols (this resolution should be pushed
 	// into Pass #2 in the future to amortize the cost).
-	top = resolveSymbols(top)
-	if numTotalErrs > 0 {
-		exit(1)
+	top = c.resolveSymbols(top)
+	if c.numTotalErrs > 0 {
+		return nil
 	}
 	dbg("Finished Pass #1.5\n")
+	if res != nil {
+		c.buildFirst(top)
+		c.buildFollow(top)
+		res.Grammar = c.buildModel(top)
+		c.first = make(map[*Node]map[*Node]bool)
+		c.follow = make(map[*Node]map[*Node]bool)
+	}
+
+	// Pass #1.75: Look for symbols that are defined but of no use.
+	c.lint(top)
+	if c.numTotalErrs > 0 {
+		return nil
+	}
 
 	if opt['0'] {
 		top.dumpTree()
 	}
 
 	// Pass #2: Type check and transform the tree into a valid LL(1) grammar.
-	typeCheck(top)
+	c.typeCheck(top)
 	dbg("Finished Pass #2\n")
 
-	if numTotalErrs > 0 {
-		exit(1)
+	if c.numTotalErrs > 0 {
+		return nil
+	}
+	if res != nil {
+		if c.backend == "lalr" || c.backend == "earley" {
+			res.Transformed = res.Grammar
+		} else {
+			res.Transformed = c.buildModel(top)
+		}
 	}
 
 	// Pass #3: Generate code in memory for the generated compiler. At this point
 	// we should be error free. Use panics to check for cases that should never
 	// occur.
-	codeGen(top)
+	c.codeGen(top)
 	dbg("Finished Pass #3\n")
 
-	// Pass #4: Dump out the generated code
-	//codeDump(top)
-	dbg("Finished Pass #4\n")
-
-	// Clean up with gofmt
-	gofmt()
+	if c.numTotalErrs > 0 {
+		return nil
+	}
+	return top
+}
 
-	dbg("Compilation finished\n")
-	exit(0)
+// generate returns the formatted code of the parser for top, as returned
+// by compile.
+func (c *compiler) generate(top *Node) []byte {
+	var buf bytes.Buffer
+	c.codeout = bufio.NewWriter(&buf)
+	c.codeDump(top)
+	c.codeout.Flush()
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		// Leave the code as is for the Go compiler to explain
+		return buf.Bytes()
+	}
+	return code
 }
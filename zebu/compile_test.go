@@ -0,0 +1,79 @@
+// compile_test.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// The zebu command is tested by running the test binary again with
+// ZEBU_ARGS set, which makes TestZebuCommand call Main with them.
+
+func TestZebuCommand(t *testing.T) {
+	args, ok := os.LookupEnv("ZEBU_ARGS")
+	if !ok {
+		t.Skip("runs Main for the tests of the zebu command")
+	}
+	os.Args = append([]string{"zebu"}, strings.Fields(args)...)
+	Main()
+}
+
+// zebu runs the zebu command with args on stdin, and returns what it
+// writes to stdout and stderr and its exit status.
+func zebu(t *testing.T, args string, stdin []byte) (stdout, stderr []byte, status int) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestZebuCommand$")
+	cmd.Env = append(os.Environ(), "ZEBU_ARGS="+args)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var out, errout bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errout
+	if err := cmd.Run(); err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		status = ee.ExitCode()
+	}
+	return out.Bytes(), errout.Bytes(), status
+}
+
+// With -o - the standard output only has the generated code, the
+// diagnostics go to the standard error.
+func TestZebuStdio(t *testing.T) {
+	src, err := os.ReadFile("../test/ll_arith.zb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Compile(bytes.NewReader(src), "<stdin>", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, status := zebu(t, "-o - -", src)
+	if status != 0 || !bytes.Equal(stdout, res.Code) || len(stderr) != 0 {
+		t.Errorf("zebu -o - -: exit status %d, %d bytes of code, stderr %q; want 0, the %d bytes of Compile and nothing",
+			status, len(stdout), stderr, len(res.Code))
+	}
+
+	for _, tc := range []struct {
+		args   string
+		src    string
+		status int
+		msg    string
+	}{
+		{"-o - -", "grammar g ;\nstart : missing ;\n", 1, "<stdin>:2:9: unresolved nonterminal symbol missing."},
+		{"-backend=none -o - -", "", 2, "unknown backend none."},
+		{"-diagnostics=none -o - -", "", 2, "unknown diagnostics format none."},
+		{"-diagnostics=json -backend=none -o - -", "", 2, `"code": "ZB0702"`},
+	} {
+		stdout, stderr, status := zebu(t, tc.args, []byte(tc.src))
+		if status != tc.status || len(stdout) != 0 || !strings.Contains(string(stderr), tc.msg) {
+			t.Errorf("zebu %s: exit status %d, stdout %q, stderr %q; want %d, nothing and %q",
+				tc.args, status, stdout, stderr, tc.status, tc.msg)
+		}
+	}
+}
@@ -0,0 +1,735 @@
+// dfa.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The generated lexer is a single minimized DFA. Every token (a regdef or
+// a string literal) is compiled into an NFA using Thompson's construction,
+// all NFAs share one start state, and the result is determinized with the
+// subset construction and minimized by partition refinement. When two tokens
+// accept the same input, the one with the lower priority wins: string
+// literals first, in order of appearance, then regdefs in declaration order.
+//
+// Keywords are left out of the DFA. Each keyword is owned by the first
+// regdef matching it, and the generated lexer turns a match of the owner
+// into the keyword through a table.
+//
+// Each lexer mode gets a DFA of its own tokens: the regdefs declared in
+// its blocks, and for the default mode the other regdefs and the string
+// literals. The DFAs share one table of states, each starting at one of
+// starts.
+//
+// The characters of the DFA are runes, its input is decoded from UTF-8.
+
+const maxChar = unicode.MaxRune
+
+type charRange struct {
+	lo int
+	hi int
+}
+
+type nfaEdge struct {
+	r  charRange
+	to *nfaState
+}
+
+type nfaState struct {
+	id    int
+	eps   []*nfaState
+	edges []nfaEdge
+	tok   *Node // token accepted by this state, nil if none
+}
+
+type NFA struct {
+	c      *compiler
+	states []*nfaState
+	active map[*Node]bool // regdefs being expanded, to catch recursion
+}
+
+type nfaFrag struct {
+	start *nfaState
+	end   *nfaState
+}
+
+func consNFA(c *compiler) *NFA {
+	return &NFA{
+		c:      c,
+		states: make([]*nfaState, 0),
+		active: make(map[*Node]bool),
+	}
+}
+
+func (a *NFA) state() (s *nfaState) {
+	s = &nfaState{
+		id: len(a.states),
+	}
+	a.states = append(a.states, s)
+	return
+}
+
+func (a *NFA) char(r charRange) (f nfaFrag) {
+	f.start, f.end = a.state(), a.state()
+	f.start.edges = append(f.start.edges, nfaEdge{r: r, to: f.end})
+	return
+}
+
+func (a *NFA) empty() (f nfaFrag) {
+	f.start, f.end = a.state(), a.state()
+	f.start.eps = append(f.start.eps, f.end)
+	return
+}
+
+func (a *NFA) cat(f1, f2 nfaFrag) nfaFrag {
+	f1.end.eps = append(f1.end.eps, f2.start)
+	return nfaFrag{start: f1.start, end: f2.end}
+}
+
+func (a *NFA) alt(f1, f2 nfaFrag) (f nfaFrag) {
+	f.start, f.end = a.state(), a.state()
+	f.start.eps = append(f.start.eps, f1.start, f2.start)
+	f1.end.eps = append(f1.end.eps, f.end)
+	f2.end.eps = append(f2.end.eps, f.end)
+	return
+}
+
+func (a *NFA) kleene(f1 nfaFrag) (f nfaFrag) {
+	f.start, f.end = a.state(), a.state()
+	f.start.eps = append(f.start.eps, f1.start, f.end)
+	f1.end.eps = append(f1.end.eps, f1.start, f.end)
+	return
+}
+
+func (a *NFA) optional(f1 nfaFrag) nfaFrag {
+	f1.start.eps = append(f1.start.eps, f1.end)
+	return f1
+}
+
+// build compiles the regex tree rooted at n. Each call creates fresh
+// states, so a subtree can be built as many times as a repeat requires.
+func (a *NFA) build(n *Node) (f nfaFrag, err error) {
+	switch n.op {
+	case OREGDEF:
+		if a.active[n] {
+			err = a.c.compileError(n.pos, "regular definition %s is recursive.", n.sym)
+			return
+		}
+		a.active[n] = true
+		f, err = a.build(n.left)
+		delete(a.active, n)
+	case OSTRLIT:
+		f = a.empty()
+		for _, c := range n.lit.lit {
+			f = a.cat(f, a.char(charRange{int(c), int(c)}))
+		}
+	case OCHAR:
+		f = a.char(charRange{int(n.char), int(n.char)})
+	case OCLASS:
+		f.start, f.end = a.state(), a.state()
+		for _, r := range classRanges(n) {
+			f.start.edges = append(f.start.edges, nfaEdge{r: r, to: f.end})
+		}
+	case OCAT, OALT:
+		var f1, f2 nfaFrag
+		if f1, err = a.build(n.left); err != nil {
+			return
+		}
+		if f2, err = a.build(n.right); err != nil {
+			return
+		}
+		if n.op == OCAT {
+			f = a.cat(f1, f2)
+		} else {
+			f = a.alt(f1, f2)
+		}
+	case OKLEENE:
+		var f1 nfaFrag
+		if f1, err = a.build(n.left); err != nil {
+			return
+		}
+		f = a.kleene(f1)
+	case OPLUS:
+		var f1, f2 nfaFrag
+		if f1, err = a.build(n.left); err != nil {
+			return
+		}
+		if f2, err = a.build(n.left); err != nil {
+			return
+		}
+		f = a.cat(f1, a.kleene(f2))
+	case OREPEAT:
+		f, err = a.repeat(n)
+	default:
+		panic(fmt.Sprintf("unexpected op %s while building nfa", n.op))
+	}
+	return
+}
+
+// repeat expands e{lb,ub} into lb copies of e followed by either a
+// kleene closure (no upper bound) or ub-lb optional copies.
+func (a *NFA) repeat(n *Node) (f nfaFrag, err error) {
+	lb, ub := n.lb, n.ub
+	if lb < 0 {
+		lb = 0
+	}
+	if ub >= 0 && ub < lb {
+		err = a.c.compileError(n.pos, "repeat upper bound %d is less than lower bound %d.", ub, lb)
+		return
+	}
+	f = a.empty()
+	var f1 nfaFrag
+	for i := 0; i < lb; i++ {
+		if f1, err = a.build(n.left); err != nil {
+			return
+		}
+		f = a.cat(f, f1)
+	}
+	if ub < 0 {
+		if f1, err = a.build(n.left); err != nil {
+			return
+		}
+		f = a.cat(f, a.kleene(f1))
+		return
+	}
+	for i := lb; i < ub; i++ {
+		if f1, err = a.build(n.left); err != nil {
+			return
+		}
+		f = a.cat(f, a.optional(f1))
+	}
+	return
+}
+
+// classRanges returns the sorted, merged set of ranges matched by an
+// OCLASS node, taking negation into account.
+func classRanges(n *Node) []charRange {
+	rs := make([]charRange, 0, len(n.nodes))
+	for _, n1 := range n.nodes {
+		switch n1.op {
+		case OCHAR:
+			rs = append(rs, charRange{int(n1.char), int(n1.char)})
+		case ORANGE:
+			lo, hi := int(n1.left.char), int(n1.right.char)
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			rs = append(rs, charRange{lo, hi})
+		case OCATEGORY:
+			rs = append(rs, categoryRanges(n1)...)
+		default:
+			panic(fmt.Sprintf("unexpected op %s in character class", n1.op))
+		}
+	}
+	rs = mergeRanges(rs)
+	if !n.neg {
+		return rs
+	}
+	return negateRanges(rs)
+}
+
+// negateRanges returns the characters missing from the sorted, merged
+// ranges rs.
+func negateRanges(rs []charRange) []charRange {
+	neg := make([]charRange, 0, len(rs)+1)
+	lo := 0
+	for _, r := range rs {
+		if r.lo > lo {
+			neg = append(neg, charRange{lo, r.lo - 1})
+		}
+		lo = r.hi + 1
+	}
+	if lo <= maxChar {
+		neg = append(neg, charRange{lo, maxChar})
+	}
+	return neg
+}
+
+// unicodeTable returns the Unicode category or script named name, nil
+// if there is none.
+func unicodeTable(name string) *unicode.RangeTable {
+	if t, ok := unicode.Categories[name]; ok {
+		return t
+	}
+	return unicode.Scripts[name]
+}
+
+// categoryRanges returns the sorted, merged ranges of the characters of
+// an OCATEGORY node.
+func categoryRanges(n *Node) []charRange {
+	t := unicodeTable(n.cat)
+	if t == nil {
+		return nil
+	}
+	rs := make([]charRange, 0, len(t.R16)+len(t.R32))
+	add := func(lo, hi, stride int) {
+		if stride == 1 {
+			rs = append(rs, charRange{lo, hi})
+			return
+		}
+		for c := lo; c <= hi; c += stride {
+			rs = append(rs, charRange{c, c})
+		}
+	}
+	for _, r := range t.R16 {
+		add(int(r.Lo), int(r.Hi), int(r.Stride))
+	}
+	for _, r := range t.R32 {
+		add(int(r.Lo), int(r.Hi), int(r.Stride))
+	}
+	rs = mergeRanges(rs)
+	if n.neg {
+		return negateRanges(rs)
+	}
+	return rs
+}
+
+func mergeRanges(rs []charRange) []charRange {
+	if len(rs) == 0 {
+		return rs
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].lo < rs[j].lo })
+	out := rs[:1]
+	for _, r := range rs[1:] {
+		last := &out[len(out)-1]
+		if r.lo <= last.hi+1 {
+			if r.hi > last.hi {
+				last.hi = r.hi
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+type dfaEdge struct {
+	r  charRange
+	to int
+}
+
+type dfaState struct {
+	id    int
+	edges []dfaEdge // sorted by range, ranges never overlap
+	tok   *Node
+}
+
+type DFA struct {
+	states   []*dfaState
+	toks     []*Node         // tokens in priority order
+	prio     map[*Node]int   // index of each token in toks
+	keywords map[*Node]*Node // regdef owning each keyword
+	modes    []string        // lexer modes, the default one first
+	starts   []int           // start state of each mode
+}
+
+// lexTokens returns the tokens of the grammar in priority order. String
+// literals are collected from rule productions. A regdef is a token if a
+// rule refers to it, if no other regdef does, or if it is skipped or
+// hidden; regdefs only used inside other regdefs are fragments and never
+// produce a token of their own.
+func lexTokens(top *Node) []*Node {
+	lits := make([]*Node, 0)
+	seen := make(map[*Node]bool)
+	used := make(map[*Node]bool)
+	frag := make(map[*Node]bool)
+
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n == nil {
+			return
+		}
+		if n.op == OREGDEF {
+			frag[n] = true
+			return
+		}
+		walk(n.left)
+		walk(n.right)
+		for _, n1 := range n.nodes {
+			walk(n1)
+		}
+	}
+
+	for _, dcl := range top.nodes {
+		switch dcl.op {
+		case ORULE:
+			for _, prod := range dcl.nodes {
+				for _, elem := range prod.nodes {
+					e := elem.left
+					switch e.op {
+					case OSTRLIT:
+						if !seen[e] {
+							seen[e] = true
+							lits = append(lits, e)
+						}
+					case OREGDEF:
+						used[e] = true
+					}
+				}
+			}
+		case OREGDEF:
+			walk(dcl.left)
+		case OKEYWORD:
+			for _, e := range dcl.nodes {
+				if !seen[e] {
+					seen[e] = true
+					lits = append(lits, e)
+				}
+			}
+		}
+	}
+
+	toks := lits
+	for _, dcl := range top.nodes {
+		if dcl.op == OREGDEF && (used[dcl] || !frag[dcl] || hiddenBy(dcl) != "") {
+			toks = append(toks, dcl)
+		}
+	}
+	return toks
+}
+
+// buildLexer compiles every token of the grammar into a single
+// minimized DFA.
+func (c *compiler) buildLexer(top *Node) (d *DFA) {
+	d = &DFA{
+		toks:     lexTokens(top),
+		prio:     make(map[*Node]int),
+		keywords: make(map[*Node]*Node),
+	}
+
+	kwpos := make(map[*Node]*Position)
+	for _, dcl := range top.nodes {
+		if dcl.op == OKEYWORD {
+			for _, e := range dcl.nodes {
+				kwpos[e] = dcl.pos
+			}
+		}
+	}
+
+	a := consNFA(c)
+	frags := make(map[*Node]nfaFrag)
+	for i, tok := range d.toks {
+		d.prio[tok] = i
+		f, err := a.build(tok)
+		if err != nil {
+			continue
+		}
+		f.end.tok = tok
+		frags[tok] = f
+
+		// A token matching nothing would stall the lexer
+		for _, s := range closure([]*nfaState{f.start}) {
+			if s != f.end {
+				continue
+			}
+			if tok.op == OSTRLIT {
+				c.compileError(top.pos, "string literal '%s' matches the empty string.", escapeStrlit(tok.lit.lit))
+			} else {
+				c.compileError(tok.pos, "regular definition %s matches the empty string.", tok.sym)
+			}
+		}
+	}
+
+	for _, tok := range d.toks {
+		if kwpos[tok] == nil {
+			continue
+		}
+		for _, r := range d.toks {
+			if f, ok := frags[r]; ok && r.op == OREGDEF && f.matches(tok.lit.lit) {
+				d.keywords[tok] = r
+				break
+			}
+		}
+		if d.keywords[tok] == nil {
+			c.compileWarning(kwpos[tok], "keyword '%s' is not matched by any regular definition.", escapeStrlit(tok.lit.lit))
+		}
+	}
+
+	// Every mode a command switches to needs a block
+	d.modes = []string{defaultMode}
+	for _, tok := range d.toks {
+		if tok.op == OREGDEF && tok.mode != "" && !hasMode(d.modes, tok.mode) {
+			d.modes = append(d.modes, tok.mode)
+		}
+	}
+	for _, tok := range d.toks {
+		if tok.op != OREGDEF {
+			continue
+		}
+		for _, cmd := range tok.cmds {
+			if cmd.mode != "" && !hasMode(d.modes, cmd.mode) {
+				c.compileError(cmd.pos, "lexer mode %s is not defined.", cmd.mode)
+			}
+		}
+	}
+
+	for _, mode := range d.modes {
+		start := a.state()
+		for _, tok := range d.toks {
+			if f, ok := frags[tok]; ok && d.keywords[tok] == nil && tokMode(tok) == mode {
+				start.eps = append(start.eps, f.start)
+			}
+		}
+		m := &DFA{prio: d.prio}
+		m.subset(a, start)
+		m.minimize()
+
+		// Append the states of the mode, renumbered
+		off := len(d.states)
+		d.starts = append(d.starts, off)
+		for _, s := range m.states {
+			s.id += off
+			for i := range s.edges {
+				s.edges[i].to += off
+			}
+			d.states = append(d.states, s)
+		}
+	}
+	return
+}
+
+// tokMode returns the lexer mode of the token tok.
+func tokMode(tok *Node) string {
+	if tok.op == OREGDEF && tok.mode != "" {
+		return tok.mode
+	}
+	return defaultMode
+}
+
+func hasMode(l []string, mode string) bool {
+	for _, m := range l {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// intervals splits the character space into the elementary intervals
+// induced by every edge of the NFA. Any two characters inside the same
+// interval behave identically in every state.
+func intervals(a *NFA) []charRange {
+	cuts := map[int]bool{0: true, maxChar + 1: true}
+	for _, s := range a.states {
+		for _, e := range s.edges {
+			cuts[e.r.lo] = true
+			cuts[e.r.hi+1] = true
+		}
+	}
+	pts := make([]int, 0, len(cuts))
+	for c := range cuts {
+		pts = append(pts, c)
+	}
+	sort.Ints(pts)
+	ivs := make([]charRange, 0, len(pts))
+	for i := 0; i+1 < len(pts); i++ {
+		ivs = append(ivs, charRange{pts[i], pts[i+1] - 1})
+	}
+	return ivs
+}
+
+func closure(set []*nfaState) []*nfaState {
+	in := make(map[*nfaState]bool)
+	stack := make([]*nfaState, 0, len(set))
+	for _, s := range set {
+		if !in[s] {
+			in[s] = true
+			stack = append(stack, s)
+		}
+	}
+	out := make([]*nfaState, 0, len(set))
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		out = append(out, s)
+		for _, t := range s.eps {
+			if !in[t] {
+				in[t] = true
+				stack = append(stack, t)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// matches reports whether f accepts exactly s.
+func (f nfaFrag) matches(s string) bool {
+	set := closure([]*nfaState{f.start})
+	for _, c := range s {
+		next := make([]*nfaState, 0)
+		for _, st := range set {
+			for _, e := range st.edges {
+				if e.r.lo <= int(c) && int(c) <= e.r.hi {
+					next = append(next, e.to)
+				}
+			}
+		}
+		set = closure(next)
+	}
+	for _, st := range set {
+		if st == f.end {
+			return true
+		}
+	}
+	return false
+}
+
+func setKey(set []*nfaState) string {
+	var b strings.Builder
+	for _, s := range set {
+		fmt.Fprintf(&b, "%d,", s.id)
+	}
+	return b.String()
+}
+
+func (d *DFA) subset(a *NFA, start *nfaState) {
+	ivs := intervals(a)
+	d.states = make([]*dfaState, 0)
+	ids := make(map[string]int)
+	sets := make([][]*nfaState, 0)
+
+	add := func(set []*nfaState) int {
+		key := setKey(set)
+		if id, ok := ids[key]; ok {
+			return id
+		}
+		s := &dfaState{id: len(d.states)}
+		for _, ns := range set {
+			if ns.tok != nil && (s.tok == nil || d.prio[ns.tok] < d.prio[s.tok]) {
+				s.tok = ns.tok
+			}
+		}
+		ids[key] = s.id
+		d.states = append(d.states, s)
+		sets = append(sets, set)
+		return s.id
+	}
+
+	add(closure([]*nfaState{start}))
+	for i := 0; i < len(d.states); i++ {
+		for _, iv := range ivs {
+			move := make([]*nfaState, 0)
+			for _, ns := range sets[i] {
+				for _, e := range ns.edges {
+					if e.r.lo <= iv.lo && iv.hi <= e.r.hi {
+						move = append(move, e.to)
+					}
+				}
+			}
+			if len(move) == 0 {
+				continue
+			}
+			to := add(closure(move))
+			d.states[i].edges = append(d.states[i].edges, dfaEdge{r: iv, to: to})
+		}
+	}
+	d.compact()
+}
+
+// compact merges adjacent edges of a state that lead to the same target.
+func (d *DFA) compact() {
+	for _, s := range d.states {
+		if len(s.edges) == 0 {
+			continue
+		}
+		out := s.edges[:1]
+		for _, e := range s.edges[1:] {
+			last := &out[len(out)-1]
+			if last.to == e.to && last.r.hi+1 == e.r.lo {
+				last.r.hi = e.r.hi
+				continue
+			}
+			out = append(out, e)
+		}
+		s.edges = out
+	}
+}
+
+func (d *DFA) step(s *dfaState, c int) int {
+	for _, e := range s.edges {
+		if e.r.lo <= c && c <= e.r.hi {
+			return e.to
+		}
+	}
+	return -1
+}
+
+// minimize merges equivalent states with Moore's partition refinement.
+// States start partitioned by the token they accept and are split until
+// every member of a block moves to the same block on every interval.
+func (d *DFA) minimize() {
+	cuts := map[int]bool{0: true, maxChar + 1: true}
+	for _, s := range d.states {
+		for _, e := range s.edges {
+			cuts[e.r.lo] = true
+			cuts[e.r.hi+1] = true
+		}
+	}
+	pts := make([]int, 0, len(cuts))
+	for c := range cuts {
+		pts = append(pts, c)
+	}
+	sort.Ints(pts)
+
+	block := make([]int, len(d.states))
+	for i, s := range d.states {
+		if s.tok != nil {
+			block[i] = d.prio[s.tok] + 1
+		}
+	}
+
+	nblocks := -1
+	for {
+		keys := make(map[string]int)
+		next := make([]int, len(d.states))
+		for i, s := range d.states {
+			var b strings.Builder
+			fmt.Fprintf(&b, "%d:", block[i])
+			for _, c := range pts[:len(pts)-1] {
+				to := d.step(s, c)
+				if to >= 0 {
+					to = block[to]
+				}
+				fmt.Fprintf(&b, "%d,", to)
+			}
+			key := b.String()
+			id, ok := keys[key]
+			if !ok {
+				id = len(keys)
+				keys[key] = id
+			}
+			next[i] = id
+		}
+		block = next
+		if len(keys) == nblocks {
+			break
+		}
+		nblocks = len(keys)
+	}
+
+	// Renumber blocks so the start state stays 0, then rebuild the states.
+	order := make(map[int]int)
+	states := make([]*dfaState, 0, nblocks)
+	for i, s := range d.states {
+		if _, ok := order[block[i]]; ok {
+			continue
+		}
+		order[block[i]] = len(states)
+		states = append(states, &dfaState{id: len(states), tok: s.tok, edges: s.edges})
+	}
+	for _, s := range states {
+		edges := make([]dfaEdge, len(s.edges))
+		for i, e := range s.edges {
+			edges[i] = dfaEdge{r: e.r, to: order[block[e.to]]}
+		}
+		s.edges = edges
+	}
+	d.states = states
+	d.compact()
+}
@@ -0,0 +1,383 @@
+// diag.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Diagnostics are printed as text lines by default. With -diagnostics=json
+// or -diagnostics=sarif they are written to stdout as structured records
+// instead, for tools that annotate sources with them.
+
+// diagCodes gives every diagnostic a stable code, looked up by the format
+// of its message. A message that is reworded keeps its code: update the
+// key here along with it.
+var diagCodes = map[string]string{
+	// Syntax
+	"expected %s":    "ZB0001",
+	"expected {":     "ZB0002",
+	"unexpected %s.": "ZB0003",
+	"expected regular definition or string literal, found %s":      "ZB0004",
+	"expected terminal or nonterminal declaration, found %s":       "ZB0005",
+	"expected rule or regular definition after override, found %s": "ZB0006",
+	"expected rule or regular definition after delete, found %s":   "ZB0007",
+	"expected + or - before production, found %s":                  "ZB0008",
+	"undeclared regular definition!":                               "ZB0009",
+	"grammar must define a start rule.":                            "ZB0010",
+	"unknown escape sequence \\%c in string literal.":              "ZB0011",
+	"unterminated string literal.":                                 "ZB0012",
+	"unterminated comment.":                                        "ZB0013",
+	"identifier too long.":                                         "ZB0014",
+	"number out of range.":                                         "ZB0015",
+	"string literal too long.":                                     "ZB0016",
+	"unterminated action, missing }.":                              "ZB0017",
+	"unterminated type declaration, missing :.":                    "ZB0018",
+	"unterminated code block, missing @}.":                         "ZB0019",
+	"invalid UTF-8 encoding.":                                      "ZB0020",
+	"unknown escape sequence \\%c in character class.":             "ZB0021",
+	"invalid escape sequence, expected %d hex digits.":             "ZB0022",
+	"escape sequence is not a valid Unicode code point.":           "ZB0023",
+	"unterminated Unicode category, missing }.":                    "ZB0024",
+	"expected lexer command, found %s":                             "ZB0025",
+	"unknown lexer command %s.":                                    "ZB0026",
+	"expected lexer mode name, found %s":                           "ZB0027",
+	"expected mode after lexer, found %s":                          "ZB0028",
+	"expected regular definition in lexer mode %s, found %s":       "ZB0029",
+	"lexer commands %s and %s cannot be used together.":            "ZB0030",
+	"expected type":               "ZB0031",
+	"invalid type declaration %s": "ZB0032",
+
+	// Grammar files
+	"could not open %s.":                 "ZB0101",
+	"cannot find imported grammar '%s'.": "ZB0102",
+	"import cycle: %s%s.":                "ZB0103",
+	"cannot find base grammar %s.":       "ZB0104",
+	"grammar %s already loaded from %s.": "ZB0105",
+
+	// Symbols
+	"%s previously defined at %s.":                            "ZB0201",
+	"%s is defined by both %s and %s.":                        "ZB0202",
+	"%s is deleted but still used.":                           "ZB0203",
+	"unresolved terminal symbol %s.":                          "ZB0204",
+	"unresolved nonterminal symbol %s.":                       "ZB0205",
+	"cannot %s %s, no %s of that name is defined.":            "ZB0206",
+	"%s has no such production to remove.":                    "ZB0207",
+	"removing the last production of %s, use delete instead.": "ZB0208",
+	"%s is the grammar name, not a rule.":                     "ZB0209",
+
+	// Lexical
+	"regular definition %s is recursive.":                       "ZB0301",
+	"repeat upper bound %d is less than lower bound %d.":        "ZB0302",
+	"string literal '%s' matches the empty string.":             "ZB0303",
+	"regular definition %s matches the empty string.":           "ZB0304",
+	"keyword '%s' is not matched by any regular definition.":    "ZB0305",
+	"sync token %s is not a token of the grammar.":              "ZB0306",
+	"unknown Unicode category or script %s.":                    "ZB0307",
+	"lexer mode %s is not defined.":                             "ZB0308",
+	"regular definition %s is %s and never reaches the parser.": "ZB0309",
+	"sync has no effect with the %s backend.":                   "ZB0310",
+
+	// Actions and types
+	"undefined variable id %s":                          "ZB0401",
+	"$$ used in %s, which has no type":                  "ZB0402",
+	"no conversion from token text to type %s":          "ZB0403",
+	"%s refers to an empty element, which has no value": "ZB0404",
+	"%s refers to an action, which has no value":        "ZB0405",
+	"%s refers to %s, which has no type":                "ZB0406",
+
+	// Grammar analysis
+	"%s is ambiguous: %s conflict on %s between %s (%s) and %s (%s), as in %s":               "ZB0501",
+	"%s can derive itself, which no parser can handle":                                       "ZB0502",
+	"left recursion of %s through %s is hidden behind an action":                             "ZB0503",
+	"left recursion of %s through %s is hidden behind %s, which can derive the empty string": "ZB0504",
+	"cannot remove the left recursion of %s through %s, which has a type; try -backend=lalr": "ZB0505",
+	"shift/reduce conflict in %s on %s, resolved as shift.":                                  "ZB0506",
+	"reduce/reduce conflict between %s and %s on %s.":                                        "ZB0507",
+
+	// Lint
+	"regular definition %s is never used.":      "ZB0601",
+	"rule %s is not reachable from %s.":         "ZB0602",
+	"rule %s never derives a string of tokens.": "ZB0603",
+	"%s is never used.":                         "ZB0604",
+
+	// Command line
+	"unknown diagnostics format %s.": "ZB0701",
+	"unknown backend %s.":            "ZB0702",
+	"failed to create file %s.":      "ZB0703",
+}
+
+// diagCode returns the code of ce, or ZB0000 for a message missing from
+// diagCodes.
+func diagCode(ce *CCError) string {
+	if code, ok := diagCodes[ce.format]; ok {
+		return code
+	}
+	return "ZB0000"
+}
+
+func diagSeverity(ce *CCError) string {
+	if ce.warn {
+		return "warning"
+	}
+	return "error"
+}
+
+type diagPos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type diagLocation struct {
+	File  string  `json:"file"`
+	Start diagPos `json:"start"`
+	End   diagPos `json:"end"`
+}
+
+type diagRelated struct {
+	Message string `json:"message"`
+	diagLocation
+}
+
+type diagRecord struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	diagLocation
+	Related []diagRelated `json:"related,omitempty"`
+}
+
+// diagLoc returns the location of p. The end column is the one after the
+// last character, as in SARIF.
+func (c *compiler) diagLoc(p *Position) diagLocation {
+	if p == nil {
+		return diagLocation{}
+	}
+	line, col := c.endPos(p)
+	return diagLocation{
+		File:  p.file,
+		Start: diagPos{p.line, p.col},
+		End:   diagPos{line, col},
+	}
+}
+
+// sourceBuffer returns an empty buffer to keep the text of file in.
+func (c *compiler) sourceBuffer(file string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	c.sources[file] = buf
+	return buf
+}
+
+func (c *compiler) source(file string) []byte {
+	if buf, ok := c.sources[file]; ok {
+		return buf.Bytes()
+	}
+	return nil
+}
+
+// endPos returns the line and column of the end of p.
+func (c *compiler) endPos(p *Position) (line, col int) {
+	line, col = p.line, p.col+p.end-p.off
+	src := c.source(p.file)
+	if p.end > len(src) || p.off > p.end {
+		return
+	}
+	text := src[p.off:p.end]
+	if n := bytes.Count(text, []byte{'\n'}); n > 0 {
+		line += n
+		col = len(text) - bytes.LastIndexByte(text, '\n')
+	}
+	return
+}
+
+// snippet returns the source line of p, indented by a tab, and under it
+// a ^~~~ marking the range of p on that line.
+func (c *compiler) snippet(p *Position) string {
+	if p == nil {
+		return ""
+	}
+	src := c.source(p.file)
+	if p.off > len(src) {
+		return ""
+	}
+	start := bytes.LastIndexByte(src[:p.off], '\n') + 1
+	stop := bytes.IndexByte(src[p.off:], '\n')
+	if stop < 0 {
+		stop = len(src)
+	} else {
+		stop += p.off
+	}
+	line := bytes.TrimRight(src[start:stop], "\r")
+
+	// Keep the tabs before the range so the marker lines up, one
+	// column per character
+	marker := make([]byte, 0, len(line)+1)
+	for _, c := range string(src[start:p.off]) {
+		if c == '\t' {
+			marker = append(marker, '\t')
+		} else {
+			marker = append(marker, ' ')
+		}
+	}
+	marker = append(marker, '^')
+	if p.end > p.off && p.off < stop {
+		end := p.end
+		if end > stop {
+			end = stop
+		}
+		for n := utf8.RuneCount(src[p.off:end]); n > 1; n-- {
+			marker = append(marker, '~')
+		}
+	}
+	return fmt.Sprintf("\t%s\n\t%s\n", line, marker)
+}
+
+func (c *compiler) textDump(errs []*CCError) {
+	for _, ce := range errs {
+		if ce.pos != nil {
+			fmt.Fprintf(c.diagout, "%s: ", ce.pos)
+		}
+		if ce.warn {
+			fmt.Fprintf(c.diagout, "warning: %s\n", ce.msg)
+		} else {
+			fmt.Fprintf(c.diagout, "%s\n", ce.msg)
+		}
+		fmt.Fprint(c.diagout, c.snippet(ce.pos))
+		for _, r := range ce.related {
+			fmt.Fprintf(c.diagout, "%s: note: %s\n", r.pos, r.msg)
+			fmt.Fprint(c.diagout, c.snippet(r.pos))
+		}
+	}
+}
+
+func (c *compiler) jsonDump(errs []*CCError) {
+	recs := make([]diagRecord, 0, len(errs))
+	for _, ce := range errs {
+		rec := diagRecord{
+			Severity:     diagSeverity(ce),
+			Code:         diagCode(ce),
+			Message:      ce.msg,
+			diagLocation: c.diagLoc(ce.pos),
+		}
+		for _, r := range ce.related {
+			rec.Related = append(rec.Related, diagRelated{r.msg, c.diagLoc(r.pos)})
+		}
+		recs = append(recs, rec)
+	}
+	c.diagWrite(recs)
+}
+
+// SARIF 2.1.0, the subset of it zebu fills in
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifLocation struct {
+	ID               *int                  `json:"id,omitempty"`
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	Message          *sarifMessage         `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           sarifRegion   `json:"region"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+func (c *compiler) sarifLoc(p *Position) sarifLocation {
+	l := c.diagLoc(p)
+	return sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifact{l.File},
+			Region:           sarifRegion{l.Start.Line, l.Start.Column, l.End.Line, l.End.Column},
+		},
+	}
+}
+
+func (c *compiler) sarifDump(errs []*CCError) {
+	run := sarifRun{
+		Tool:    sarifTool{sarifDriver{Name: "zebu", Rules: make([]sarifRule, 0)}},
+		Results: make([]sarifResult, 0, len(errs)),
+	}
+	seen := make(map[string]bool)
+	for _, ce := range errs {
+		code := diagCode(ce)
+		if !seen[code] {
+			seen[code] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{code})
+		}
+		res := sarifResult{
+			RuleID:    code,
+			Level:     diagSeverity(ce),
+			Message:   sarifMessage{ce.msg},
+			Locations: []sarifLocation{c.sarifLoc(ce.pos)},
+		}
+		for i, r := range ce.related {
+			l := c.sarifLoc(r.pos)
+			id := i
+			l.ID = &id
+			l.Message = &sarifMessage{r.msg}
+			res.RelatedLocations = append(res.RelatedLocations, l)
+		}
+		run.Results = append(run.Results, res)
+	}
+	c.diagWrite(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
+
+func (c *compiler) diagWrite(v interface{}) {
+	enc := json.NewEncoder(c.diagout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(c.diagout, "failed to write diagnostics: %s\n", err)
+	}
+}
@@ -0,0 +1,140 @@
+// diag_test.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// diagCases are grammars of the test directory and the one diagnostic
+// compiling each with backend gives.
+var diagCases = []struct {
+	file, backend     string
+	severity, code    string
+	line, col, endCol int
+}{
+	{"../test/bad_gramname.zb", "rd", "error", "ZB0209", 10, 5, 7},
+	{"../test/bad_sync_earley.zb", "earley", "warning", "ZB0310", 7, 1, 5},
+}
+
+// diagOutput compiles file as the zebu command does, and returns what it
+// prints with -diagnostics=format.
+func diagOutput(file, backend, format string) []byte {
+	c := consCompiler(backend, nil, lintChecks, false)
+	buf := new(bytes.Buffer)
+	c.diagout, c.diagfmt = buf, format
+	if top := c.compile(file, nil, nil); top != nil {
+		c.generate(top)
+	}
+	c.flushErrors()
+	return buf.Bytes()
+}
+
+func TestDiagnosticsJSON(t *testing.T) {
+	for _, tc := range diagCases {
+		var recs []diagRecord
+		if err := json.Unmarshal(diagOutput(tc.file, tc.backend, "json"), &recs); err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if len(recs) != 1 {
+			t.Errorf("%s: %d diagnostics, want 1", tc.file, len(recs))
+			continue
+		}
+		r := recs[0]
+		if r.Severity != tc.severity || r.Code != tc.code || r.File != tc.file ||
+			r.Start != (diagPos{tc.line, tc.col}) || r.End != (diagPos{tc.line, tc.endCol}) {
+			t.Errorf("%s: got %s %s %s:%d:%d-%d:%d, want %s %s %s:%d:%d-%d:%d", tc.file,
+				r.Severity, r.Code, r.File, r.Start.Line, r.Start.Column, r.End.Line, r.End.Column,
+				tc.severity, tc.code, tc.file, tc.line, tc.col, tc.line, tc.endCol)
+		}
+	}
+}
+
+func TestDiagnosticsSARIF(t *testing.T) {
+	for _, tc := range diagCases {
+		var log sarifLog
+		if err := json.Unmarshal(diagOutput(tc.file, tc.backend, "sarif"), &log); err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if log.Version != "2.1.0" || len(log.Runs) != 1 || len(log.Runs[0].Results) != 1 {
+			t.Errorf("%s: want one run of version 2.1.0 with one result, got %+v", tc.file, log)
+			continue
+		}
+		run := log.Runs[0]
+		if len(run.Tool.Driver.Rules) != 1 || run.Tool.Driver.Rules[0].ID != tc.code {
+			t.Errorf("%s: rules %v, want %s", tc.file, run.Tool.Driver.Rules, tc.code)
+		}
+		r := run.Results[0]
+		if len(r.Locations) != 1 {
+			t.Errorf("%s: %d locations, want 1", tc.file, len(r.Locations))
+			continue
+		}
+		l := r.Locations[0].PhysicalLocation
+		want := sarifRegion{tc.line, tc.col, tc.line, tc.endCol}
+		if r.Level != tc.severity || r.RuleID != tc.code || l.ArtifactLocation.URI != tc.file || l.Region != want {
+			t.Errorf("%s: got %s %s %s %+v, want %s %s %s %+v", tc.file,
+				r.Level, r.RuleID, l.ArtifactLocation.URI, l.Region, tc.severity, tc.code, tc.file, want)
+		}
+	}
+}
+
+// Every message the compiler reports must have a code in diagCodes,
+// which the formats passed to the reporting functions are checked
+// against.
+func TestDiagnosticCodes(t *testing.T) {
+	// The index of the format among the arguments of each function
+	reporters := map[string]int{
+		"consCCError":    1,
+		"compileError":   1,
+		"compileWarning": 1,
+		"lintWarning":    2,
+	}
+	files, _ := filepath.Glob("*.go")
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			var name string
+			switch fun := call.Fun.(type) {
+			case *ast.Ident:
+				name = fun.Name
+			case *ast.SelectorExpr:
+				name = fun.Sel.Name
+			}
+			i, ok := reporters[name]
+			if !ok || i >= len(call.Args) {
+				return true
+			}
+			lit, ok := call.Args[i].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			format, _ := strconv.Unquote(lit.Value)
+			if _, ok := diagCodes[format]; !ok {
+				t.Errorf("%s: message %q has no code", fset.Position(lit.Pos()), format)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,452 @@
+// earley.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+)
+
+// The Earley backend accepts any grammar zebu can resolve, ambiguous or
+// not. It takes the productions of the grammar as written, exactly as the
+// LALR(1) backend does, and the generated parser recognizes the input with
+// Earley's algorithm, predicting nullable rules as Aycock and Horspool do.
+// The parse forest is then read back from the Earley sets: a node for every
+// rule and span, with a packed alternative for each way it was derived.
+//
+// Actions run on one derivation of the forest, picked by a disambiguation
+// callback. The forest is walked in the order an LR parser would reduce it,
+// so the reduce method of the LALR(1) backend runs them unchanged.
+
+// earleySym writes the symbol s for the generated tables. Rules are
+// numbered from 1 so that a zero rule stands for a token.
+func (c *compiler) earleySym(t *LALR, s *Node) string {
+	if s.op == ORULE {
+		return fmt.Sprintf("{rule: %d}", t.index[s]+1)
+	}
+	return fmt.Sprintf("{kind: %s}", c.caseFriendly(s))
+}
+
+func (c *compiler) earleyDump(top *Node) {
+	t := c.earleytab
+	start := top.left
+
+	// 1. Tables
+	fmt.Fprintf(c.codeout, "// Rule and right hand side of every production. Production 0 is\n")
+	fmt.Fprintf(c.codeout, "// the augmented start production.\n")
+	fmt.Fprintf(c.codeout, "type zbESym struct {\n")
+	fmt.Fprintf(c.codeout, "rule int\n")
+	fmt.Fprintf(c.codeout, "kind ZbTokenKind\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "var zbEProds = [...]struct {\n")
+	fmt.Fprintf(c.codeout, "lhs int\n")
+	fmt.Fprintf(c.codeout, "rhs []zbESym\n")
+	fmt.Fprintf(c.codeout, "}{\n")
+	for i, p := range t.prods {
+		lhs := -1
+		if p.rule != nil {
+			lhs = t.index[p.rule]
+		}
+		fmt.Fprintf(c.codeout, "{%d, []zbESym{", lhs)
+		for j, s := range p.rhs {
+			if j > 0 {
+				fmt.Fprintf(c.codeout, ", ")
+			}
+			fmt.Fprintf(c.codeout, "%s", c.earleySym(t, s))
+		}
+		fmt.Fprintf(c.codeout, "}}, // %d\n", i)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// Productions of every rule\n")
+	fmt.Fprintf(c.codeout, "var zbERules = [...][]int{\n")
+	for _, r := range t.rules {
+		fmt.Fprintf(c.codeout, "{")
+		for j, k := range t.byRule[r] {
+			if j > 0 {
+				fmt.Fprintf(c.codeout, ", ")
+			}
+			fmt.Fprintf(c.codeout, "%d", k)
+		}
+		fmt.Fprintf(c.codeout, "}, // %s\n", r.sym)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbERuleNames = [...]string{")
+	for i, r := range t.rules {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		fmt.Fprintf(c.codeout, "%q", r.sym.name)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbENullable = [...]bool{")
+	for i, r := range t.rules {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		fmt.Fprintf(c.codeout, "%t", t.nullable[r])
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 2. Forest types
+	fmt.Fprintf(c.codeout, "// ZbNode is a node of the shared packed parse forest. A rule node\n")
+	fmt.Fprintf(c.codeout, "// stands for every derivation of Rule from the tokens Start up to End,\n")
+	fmt.Fprintf(c.codeout, "// each of them one of its Alts. A token node has Token set and no Alts.\n")
+	fmt.Fprintf(c.codeout, "// Nodes are shared by all the derivations using them.\n")
+	fmt.Fprintf(c.codeout, "type ZbNode struct {\n")
+	fmt.Fprintf(c.codeout, "Rule string\n")
+	fmt.Fprintf(c.codeout, "Token *ZbToken\n")
+	fmt.Fprintf(c.codeout, "Start, End int\n")
+	fmt.Fprintf(c.codeout, "Pos token.Position // position of the token Start\n")
+	fmt.Fprintf(c.codeout, "Alts []*ZbAlt\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// ZbAlt is one derivation of a rule node: the production used and the\n")
+	fmt.Fprintf(c.codeout, "// nodes derived by the symbols of its right hand side.\n")
+	fmt.Fprintf(c.codeout, "type ZbAlt struct {\n")
+	fmt.Fprintf(c.codeout, "Prod int\n")
+	fmt.Fprintf(c.codeout, "Kids []*ZbNode\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "type zbEItem struct {\n")
+	fmt.Fprintf(c.codeout, "prod, dot, origin int\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "type zbForest struct {\n")
+	fmt.Fprintf(c.codeout, "toks []*ZbToken\n")
+	fmt.Fprintf(c.codeout, "sets []map[zbEItem]bool\n")
+	fmt.Fprintf(c.codeout, "rules map[[3]int]*ZbNode\n")
+	fmt.Fprintf(c.codeout, "leaves map[int]*ZbNode\n")
+	fmt.Fprintf(c.codeout, "prefixes map[[4]int][][]*ZbNode\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 3. Recognizer
+	fmt.Fprintf(c.codeout, "// ParseForest reads a complete %s from r and returns the forest of\n", top.sym)
+	fmt.Fprintf(c.codeout, "// all its derivations.\n")
+	fmt.Fprintf(c.codeout, "func ParseForest(r io.Reader) (forest *ZbNode, err error) {\n")
+	fmt.Fprintf(c.codeout, "return ParseForestFile(nil, \"\", r)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// ParseForestFile is ParseForest for r, the file filename, which is\n")
+	fmt.Fprintf(c.codeout, "// added to fset unless fset is nil. Syntax errors are returned in a\n")
+	fmt.Fprintf(c.codeout, "// ZbErrorList.\n")
+	fmt.Fprintf(c.codeout, "func ParseForestFile(fset *token.FileSet, filename string, r io.Reader) (forest *ZbNode, err error) {\n")
+	fmt.Fprintf(c.codeout, "p, err := consZbParser(fset, filename, r)\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "defer p.finish(&err)\n")
+	fmt.Fprintf(c.codeout, "f := &zbForest{\n")
+	fmt.Fprintf(c.codeout, "rules: make(map[[3]int]*ZbNode),\n")
+	fmt.Fprintf(c.codeout, "leaves: make(map[int]*ZbNode),\n")
+	fmt.Fprintf(c.codeout, "prefixes: make(map[[4]int][][]*ZbNode),\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "var items [][]zbEItem\n")
+	fmt.Fprintf(c.codeout, "add := func(i int, it zbEItem) {\n")
+	fmt.Fprintf(c.codeout, "for len(items) <= i {\n")
+	fmt.Fprintf(c.codeout, "items = append(items, nil)\n")
+	fmt.Fprintf(c.codeout, "f.sets = append(f.sets, make(map[zbEItem]bool))\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if !f.sets[i][it] {\n")
+	fmt.Fprintf(c.codeout, "f.sets[i][it] = true\n")
+	fmt.Fprintf(c.codeout, "items[i] = append(items[i], it)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "// expected returns the tokens the items of set i can scan next\n")
+	fmt.Fprintf(c.codeout, "expected := func(i int) (kinds []ZbTokenKind) {\n")
+	fmt.Fprintf(c.codeout, "for _, it := range items[i] {\n")
+	fmt.Fprintf(c.codeout, "rhs := zbEProds[it.prod].rhs\n")
+	fmt.Fprintf(c.codeout, "if it.dot < len(rhs) && rhs[it.dot].rule == 0 {\n")
+	fmt.Fprintf(c.codeout, "kinds = append(kinds, rhs[it.dot].kind)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if f.sets[i][zbEItem{0, 1, 0}] {\n")
+	fmt.Fprintf(c.codeout, "kinds = append(kinds, ZBEOF)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "add(0, zbEItem{0, 0, 0})\n")
+	fmt.Fprintf(c.codeout, "for i := 0; ; i++ {\n")
+	fmt.Fprintf(c.codeout, "if err = p.advance(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "f.toks = append(f.toks, p.lookahead)\n")
+	fmt.Fprintf(c.codeout, "for k := 0; k < len(items[i]); k++ {\n")
+	fmt.Fprintf(c.codeout, "it := items[i][k]\n")
+	fmt.Fprintf(c.codeout, "rhs := zbEProds[it.prod].rhs\n")
+	fmt.Fprintf(c.codeout, "switch {\n")
+	fmt.Fprintf(c.codeout, "case it.dot < len(rhs) && rhs[it.dot].rule > 0:\n")
+	fmt.Fprintf(c.codeout, "for _, q := range zbERules[rhs[it.dot].rule-1] {\n")
+	fmt.Fprintf(c.codeout, "add(i, zbEItem{q, 0, i})\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if zbENullable[rhs[it.dot].rule-1] {\n")
+	fmt.Fprintf(c.codeout, "add(i, zbEItem{it.prod, it.dot + 1, it.origin})\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "case it.dot == len(rhs) && it.prod > 0:\n")
+	fmt.Fprintf(c.codeout, "lhs := zbEProds[it.prod].lhs + 1\n")
+	fmt.Fprintf(c.codeout, "for j := 0; j < len(items[it.origin]); j++ {\n")
+	fmt.Fprintf(c.codeout, "w := items[it.origin][j]\n")
+	fmt.Fprintf(c.codeout, "if w.dot < len(zbEProds[w.prod].rhs) && zbEProds[w.prod].rhs[w.dot].rule == lhs {\n")
+	fmt.Fprintf(c.codeout, "add(i, zbEItem{w.prod, w.dot + 1, w.origin})\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if p.lookahead.kind == ZBEOF {\n")
+	fmt.Fprintf(c.codeout, "if !f.sets[i][zbEItem{0, 1, 0}] {\n")
+	fmt.Fprintf(c.codeout, "err = p.unexpected(expected(i)...)\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "forest = f.rule(%d, 0, i)\n", t.index[start])
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "for _, it := range items[i] {\n")
+	fmt.Fprintf(c.codeout, "rhs := zbEProds[it.prod].rhs\n")
+	fmt.Fprintf(c.codeout, "if it.dot < len(rhs) && rhs[it.dot].rule == 0 && rhs[it.dot].kind == p.lookahead.kind {\n")
+	fmt.Fprintf(c.codeout, "add(i+1, zbEItem{it.prod, it.dot + 1, it.origin})\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if len(items) == i+1 {\n")
+	fmt.Fprintf(c.codeout, "err = p.unexpected(expected(i)...)\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 4. Reading the forest back from the Earley sets
+	fmt.Fprintf(c.codeout, "// rule returns the node of rule deriving the tokens i up to j.\n")
+	fmt.Fprintf(c.codeout, "func (f *zbForest) rule(rule, i, j int) *ZbNode {\n")
+	fmt.Fprintf(c.codeout, "key := [3]int{rule, i, j}\n")
+	fmt.Fprintf(c.codeout, "if n, ok := f.rules[key]; ok {\n")
+	fmt.Fprintf(c.codeout, "return n\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "n := &ZbNode{Rule: zbERuleNames[rule], Start: i, End: j, Pos: f.toks[i].pos}\n")
+	fmt.Fprintf(c.codeout, "f.rules[key] = n\n")
+	fmt.Fprintf(c.codeout, "for _, q := range zbERules[rule] {\n")
+	fmt.Fprintf(c.codeout, "dot := len(zbEProds[q].rhs)\n")
+	fmt.Fprintf(c.codeout, "if !f.sets[j][zbEItem{q, dot, i}] {\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "for _, kids := range f.prefix(q, dot, i, j) {\n")
+	fmt.Fprintf(c.codeout, "n.Alts = append(n.Alts, &ZbAlt{Prod: q, Kids: kids})\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return n\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// prefix returns every way the first dot symbols of production q\n")
+	fmt.Fprintf(c.codeout, "// derive the tokens i up to j.\n")
+	fmt.Fprintf(c.codeout, "func (f *zbForest) prefix(q, dot, i, j int) (all [][]*ZbNode) {\n")
+	fmt.Fprintf(c.codeout, "if dot == 0 {\n")
+	fmt.Fprintf(c.codeout, "if i == j {\n")
+	fmt.Fprintf(c.codeout, "all = [][]*ZbNode{nil}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "key := [4]int{q, dot, i, j}\n")
+	fmt.Fprintf(c.codeout, "if all, ok := f.prefixes[key]; ok {\n")
+	fmt.Fprintf(c.codeout, "return all\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "f.prefixes[key] = nil\n")
+	fmt.Fprintf(c.codeout, "sym := zbEProds[q].rhs[dot-1]\n")
+	fmt.Fprintf(c.codeout, "for k := i; k <= j; k++ {\n")
+	fmt.Fprintf(c.codeout, "if !f.sets[k][zbEItem{q, dot - 1, i}] {\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "var n *ZbNode\n")
+	fmt.Fprintf(c.codeout, "switch {\n")
+	fmt.Fprintf(c.codeout, "case sym.rule == 0:\n")
+	fmt.Fprintf(c.codeout, "if k+1 != j || f.toks[k].kind != sym.kind {\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if n = f.leaves[k]; n == nil {\n")
+	fmt.Fprintf(c.codeout, "n = &ZbNode{Token: f.toks[k], Start: k, End: j, Pos: f.toks[k].pos}\n")
+	fmt.Fprintf(c.codeout, "f.leaves[k] = n\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "default:\n")
+	fmt.Fprintf(c.codeout, "if !f.derives(sym.rule-1, k, j) {\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "n = f.rule(sym.rule-1, k, j)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "for _, kids := range f.prefix(q, dot-1, i, k) {\n")
+	fmt.Fprintf(c.codeout, "all = append(all, append(kids[:len(kids):len(kids)], n))\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "f.prefixes[key] = all\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// derives reports whether rule derives the tokens i up to j.\n")
+	fmt.Fprintf(c.codeout, "func (f *zbForest) derives(rule, i, j int) bool {\n")
+	fmt.Fprintf(c.codeout, "for _, q := range zbERules[rule] {\n")
+	fmt.Fprintf(c.codeout, "if f.sets[j][zbEItem{q, len(zbEProds[q].rhs), i}] {\n")
+	fmt.Fprintf(c.codeout, "return true\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return false\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 5. Listing derivations
+	fmt.Fprintf(c.codeout, "// Ambiguous reports whether some node of the forest n has more than one\n")
+	fmt.Fprintf(c.codeout, "// alternative.\n")
+	fmt.Fprintf(c.codeout, "func (n *ZbNode) Ambiguous() bool {\n")
+	fmt.Fprintf(c.codeout, "seen := map[*ZbNode]bool{n: true}\n")
+	fmt.Fprintf(c.codeout, "work := []*ZbNode{n}\n")
+	fmt.Fprintf(c.codeout, "for len(work) > 0 {\n")
+	fmt.Fprintf(c.codeout, "n, work = work[len(work)-1], work[:len(work)-1]\n")
+	fmt.Fprintf(c.codeout, "if len(n.Alts) > 1 {\n")
+	fmt.Fprintf(c.codeout, "return true\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "for _, a := range n.Alts {\n")
+	fmt.Fprintf(c.codeout, "for _, k := range a.Kids {\n")
+	fmt.Fprintf(c.codeout, "if !seen[k] {\n")
+	fmt.Fprintf(c.codeout, "seen[k] = true\n")
+	fmt.Fprintf(c.codeout, "work = append(work, k)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return false\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Trees returns every derivation of n as a tree of nodes with a single\n")
+	fmt.Fprintf(c.codeout, "// alternative each. Their number can grow exponentially with the input,\n")
+	fmt.Fprintf(c.codeout, "// and derivations going around a cycle of rules are left out.\n")
+	fmt.Fprintf(c.codeout, "func (n *ZbNode) Trees() []*ZbNode {\n")
+	fmt.Fprintf(c.codeout, "return n.trees(make(map[*ZbNode]bool))\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "func (n *ZbNode) trees(path map[*ZbNode]bool) (trees []*ZbNode) {\n")
+	fmt.Fprintf(c.codeout, "if n.Token != nil {\n")
+	fmt.Fprintf(c.codeout, "return []*ZbNode{n}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if path[n] {\n")
+	fmt.Fprintf(c.codeout, "return nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "path[n] = true\n")
+	fmt.Fprintf(c.codeout, "for _, a := range n.Alts {\n")
+	fmt.Fprintf(c.codeout, "all := [][]*ZbNode{nil}\n")
+	fmt.Fprintf(c.codeout, "for _, k := range a.Kids {\n")
+	fmt.Fprintf(c.codeout, "var next [][]*ZbNode\n")
+	fmt.Fprintf(c.codeout, "sub := k.trees(path)\n")
+	fmt.Fprintf(c.codeout, "for _, kids := range all {\n")
+	fmt.Fprintf(c.codeout, "for _, t := range sub {\n")
+	fmt.Fprintf(c.codeout, "next = append(next, append(kids[:len(kids):len(kids)], t))\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "all = next\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "for _, kids := range all {\n")
+	fmt.Fprintf(c.codeout, "alt := &ZbAlt{Prod: a.Prod, Kids: kids}\n")
+	fmt.Fprintf(c.codeout, "trees = append(trees, &ZbNode{Rule: n.Rule, Start: n.Start, End: n.End, Alts: []*ZbAlt{alt}})\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "delete(path, n)\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 6. Running the actions of one derivation
+	fmt.Fprintf(c.codeout, "// Parse reads a complete %s from r, running the actions of its first\n", top.sym)
+	fmt.Fprintf(c.codeout, "// derivation.\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "func Parse(r io.Reader) (result %s, err error) {\n", start.ntype.typ)
+	} else {
+		fmt.Fprintf(c.codeout, "func Parse(r io.Reader) (err error) {\n")
+	}
+	fmt.Fprintf(c.codeout, "return ParseChoose(r, nil)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// ParseFile is Parse for r, the file filename, which is added to fset\n")
+	fmt.Fprintf(c.codeout, "// unless fset is nil.\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "func ParseFile(fset *token.FileSet, filename string, r io.Reader) (result %s, err error) {\n", start.ntype.typ)
+	} else {
+		fmt.Fprintf(c.codeout, "func ParseFile(fset *token.FileSet, filename string, r io.Reader) (err error) {\n")
+	}
+	fmt.Fprintf(c.codeout, "forest, err := ParseForestFile(fset, filename, r)\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return Eval(forest, nil)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// ParseChoose reads a complete %s from r and runs the actions of the\n", top.sym)
+	fmt.Fprintf(c.codeout, "// derivation picked by choose, as Eval does.\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "func ParseChoose(r io.Reader, choose func(n *ZbNode) int) (result %s, err error) {\n", start.ntype.typ)
+	} else {
+		fmt.Fprintf(c.codeout, "func ParseChoose(r io.Reader, choose func(n *ZbNode) int) (err error) {\n")
+	}
+	fmt.Fprintf(c.codeout, "forest, err := ParseForest(r)\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return Eval(forest, choose)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Eval runs the actions of one derivation of the forest n. Where a node\n")
+	fmt.Fprintf(c.codeout, "// has more than one alternative, choose returns the index of the one to\n")
+	fmt.Fprintf(c.codeout, "// take; a nil choose always takes the first.\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "func Eval(n *ZbNode, choose func(n *ZbNode) int) (result %s, err error) {\n", start.ntype.typ)
+	} else {
+		fmt.Fprintf(c.codeout, "func Eval(n *ZbNode, choose func(n *ZbNode) int) (err error) {\n")
+	}
+	fmt.Fprintf(c.codeout, "p := &ZbParser{}\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "vals, err := p.eval(n, choose, nil, make(map[*ZbNode]bool))\n")
+		fmt.Fprintf(c.codeout, "if err == nil {\n")
+		fmt.Fprintf(c.codeout, "result, _ = vals[0].(%s)\n", start.ntype.typ)
+		fmt.Fprintf(c.codeout, "}\n")
+	} else {
+		fmt.Fprintf(c.codeout, "_, err = p.eval(n, choose, nil, make(map[*ZbNode]bool))\n")
+	}
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// eval pushes the value of n on vals, reducing its derivation the way an\n")
+	fmt.Fprintf(c.codeout, "// LR parser would.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) eval(n *ZbNode, choose func(n *ZbNode) int, vals []interface{}, path map[*ZbNode]bool) ([]interface{}, error) {\n")
+	fmt.Fprintf(c.codeout, "if n.Token != nil {\n")
+	fmt.Fprintf(c.codeout, "return append(vals, n.Token.val), nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if path[n] || len(n.Alts) == 0 {\n")
+	fmt.Fprintf(c.codeout, "return vals, fmt.Errorf(\"%%s: cyclic derivation of %%s\", n.Pos, n.Rule)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "a := n.Alts[0]\n")
+	fmt.Fprintf(c.codeout, "if len(n.Alts) > 1 && choose != nil {\n")
+	fmt.Fprintf(c.codeout, "k := choose(n)\n")
+	fmt.Fprintf(c.codeout, "if k < 0 || k >= len(n.Alts) {\n")
+	fmt.Fprintf(c.codeout, "return vals, fmt.Errorf(\"%%s: no alternative %%d of %%s\", n.Pos, k, n.Rule)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "a = n.Alts[k]\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "path[n] = true\n")
+	fmt.Fprintf(c.codeout, "defer delete(path, n)\n")
+	fmt.Fprintf(c.codeout, "base := len(vals)\n")
+	fmt.Fprintf(c.codeout, "var err error\n")
+	fmt.Fprintf(c.codeout, "for _, k := range a.Kids {\n")
+	fmt.Fprintf(c.codeout, "if vals, err = p.eval(k, choose, vals, path); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return vals, err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "v, err := p.reduce(a.Prod, vals)\n")
+	fmt.Fprintf(c.codeout, "return append(vals[:base], v), err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 7. Reductions running actions
+	c.reduceDump(t, top)
+}
@@ -0,0 +1,73 @@
+// fuzz_test.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// The fuzz targets feed arbitrary grammar files to the front end, and
+// to every pass of Compile, which must report what is wrong with them
+// instead of crashing or hanging. They are seeded with the grammars of
+// the test directory.
+//
+//	go test -fuzz=FuzzLexer ./zebu
+//	go test -fuzz=FuzzParser ./zebu
+//	go test -fuzz=FuzzCompile ./zebu
+
+func addSeeds(f *testing.F) {
+	files, _ := filepath.Glob("../test/*.zb")
+	for _, file := range files {
+		if src, err := ioutil.ReadFile(file); err == nil {
+			f.Add(src)
+		}
+	}
+}
+
+func FuzzLexer(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		c := consCompiler("rd", nil, lintChecks, false)
+		l := c.consLexer("fuzz.zb", bytes.NewReader(src), localGrammar)
+		// Every token but EOF takes at least one byte
+		for i := 0; ; i++ {
+			if i > len(src) {
+				t.Fatalf("lexer did not reach EOF after %d tokens", i)
+			}
+			if l.next().kind == EOF {
+				break
+			}
+		}
+	})
+}
+
+func FuzzParser(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		c := consCompiler("rd", nil, lintChecks, false)
+		c.parser.parse("fuzz.zb", bytes.NewReader(src))
+		for _, ce := range c.errors {
+			if ce.pos == nil {
+				t.Errorf("error without a position: %s", ce.msg)
+			}
+		}
+	})
+}
+
+func FuzzCompile(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		for _, backend := range []string{"rd", "table", "lalr", "earley"} {
+			// Imports are looked for in an empty file system
+			res, err := Compile(bytes.NewReader(src), "fuzz.zb", Options{Backend: backend, FS: fstest.MapFS{}})
+			if err == nil && res.Code == nil {
+				t.Errorf("-backend=%s: no code and no error", backend)
+			}
+		}
+	})
+}
@@ -5,6 +5,11 @@ package zebu
 
 import (
 	"fmt"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func pprint(top *Node) {
@@ -76,9 +81,28 @@ func pprintWalk(n *Node, w *CodeWriter) {
 		w.writeln(";")
 		w.exit()
 	case OREGDEF:
+		if n.mode != "" {
+			w.write("lexer mode %s { ", n.mode)
+		}
 		w.write("%s : ", n.sym)
 		pprintWalk(n.left, w)
+		if len(n.cmds) > 0 {
+			w.write(" -> %s", cmdsString(n))
+		}
 		w.write(" ; ")
+		if n.mode != "" {
+			w.write("} ")
+		}
+		w.newline()
+	case OKEYWORD:
+		w.write("keyword ")
+		for i, n1 := range n.nodes {
+			if i > 0 {
+				w.write(", ")
+			}
+			w.write("'%s'", escapeStrlit(n1.lit.lit))
+		}
+		w.write(" ;")
 		w.newline()
 	case OALT:
 		pprintWalk(n.left, w)
@@ -103,7 +127,7 @@ func pprintWalk(n *Node, w *CodeWriter) {
 			w.write("%d", n.lb)
 		}
 		w.write(",")
-		if n.lb != -1 {
+		if n.ub != -1 {
 			w.write("%d", n.ub)
 		}
 		w.write("}")
@@ -115,11 +139,13 @@ func pprintWalk(n *Node, w *CodeWriter) {
 		for _, p := range n.nodes {
 			switch p.op {
 			case OCHAR:
-				w.write("%s", string(p.byt))
+				w.write("%s", escapeClassChar(p.char))
 			case ORANGE:
-				w.write("%s", string(p.left.byt))
+				w.write("%s", escapeClassChar(p.left.char))
 				w.write("-")
-				w.write("%s", string(p.right.byt))
+				w.write("%s", escapeClassChar(p.right.char))
+			case OCATEGORY:
+				w.write("%s", categoryString(p))
 			default:
 				panic(fmt.Sprintf("unexpected op %s in pprintWalk", p.op))
 			}
@@ -130,210 +156,1219 @@ func pprintWalk(n *Node, w *CodeWriter) {
 	}
 }
 
-func codeGen(top *Node) {
+func (c *compiler) codeGen(top *Node) {
+	c.lexdfa = c.buildLexer(top)
+	for _, n := range c.lexdfa.toks {
+		if n.op == OREGDEF && n.ntype != nil && strings.Contains(tokenConv[n.ntype.typ], "strconv.") {
+			c.imports = append(c.imports, "strconv")
+			break
+		}
+	}
+	c.buildNeeds(top)
+
+	// Sync tokens must be tokens, a literal no rule uses is not. The
+	// Earley parser does not recover from errors.
+	tok := make(map[*Node]bool)
+	for _, n := range c.lexdfa.toks {
+		tok[n] = true
+	}
+	for _, dcl := range top.nodes {
+		if dcl.op != OSYNC {
+			continue
+		}
+		if c.backend == "earley" {
+			c.compileWarning(dcl.pos, "sync has no effect with the %s backend.", c.backend)
+			continue
+		}
+		for _, n := range dcl.nodes {
+			if !tok[n] {
+				c.compileWarning(dcl.pos, "sync token %s is not a token of the grammar.", tokString(n))
+				continue
+			}
+			if !hasDcl(c.synctoks, n) {
+				c.synctoks = append(c.synctoks, n)
+			}
+		}
+	}
 }
 
-func codeDump(top *Node) {
-	topDump(top)
-	lexerDump(top)
-	parserDump(top)
+// buildNeeds computes, for every rule, the element values it needs from
+// its caller. Left factoring and left recursion removal move actions
+// into new rules, away from the elements they refer to; those elements
+// are parsed by the caller and passed down as parameters.
+func (c *compiler) buildNeeds(top *Node) {
+	for _, n := range top.nodes {
+		if n.op == ORULE && n.acc != nil {
+			c.accrules[n.acc] = n
+		}
+	}
+
+	changed := true
+	for changed {
+		changed = false
+		for _, g := range top.nodes {
+			if g.op != ORULE || actionOf(g) != nil {
+				continue
+			}
+			for _, prod := range g.nodes {
+				for i, elem := range prod.nodes {
+					for _, d := range c.elemNeeds(elem) {
+						c.dclName(d)
+						if isLocal(prod, i, d) || g.acc == d || c.isAccOwner(g, d) || hasDcl(c.needs[g], d) {
+							continue
+						}
+						c.needs[g] = append(c.needs[g], d)
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	for _, l := range c.needs {
+		sort.Slice(l, func(i, j int) bool { return c.dclids[l[i]] < c.dclids[l[j]] })
+	}
+}
+
+// elemNeeds returns the element values needed to parse elem.
+func (c *compiler) elemNeeds(elem *Node) []*Node {
+	if a := actionOf(elem.left); a != nil {
+		return a.dpn
+	}
+	if elem.left.op == ORULE {
+		return c.needs[elem.left]
+	}
+	return nil
+}
+
+func hasDcl(l []*Node, d *Node) bool {
+	for _, d1 := range l {
+		if d1 == d {
+			return true
+		}
+	}
+	return false
 }
 
-var imports = []string{"bufio", "fmt", "os"}
+// isLocal reports whether d is one of the first i elements of prod.
+func isLocal(prod *Node, i int, d *Node) bool {
+	return hasDcl(prod.nodes[:i], d)
+}
 
-func topDump(top *Node) {
-	// 1. Dump supplied code
-	if len(top.code) != 0 {
-		fmt.Fprintf(codeout, "%s\n", string(top.code[:]))
+// isAccOwner reports whether g is the rule whose left recursion was
+// removed in favor of the accumulator d. Inside g, d is g's own result.
+func (c *compiler) isAccOwner(g *Node, d *Node) bool {
+	r := c.accrules[d]
+	return r != nil && r.orig == g
+}
+
+func (c *compiler) dclName(d *Node) string {
+	id, ok := c.dclids[d]
+	if !ok {
+		id = len(c.dclids) + 1
+		c.dclids[d] = id
 	}
-	fmt.Fprintf(codeout, "\n")
+	return fmt.Sprintf("zbv%d", id)
+}
 
-	// 2. Add imports required by our generated cod3
-	fmt.Fprintf(codeout, "import (\n")
-	for _, v := range imports {
-		fmt.Fprintf(codeout, "\"%s\"\n", v)
+// params returns the parameters of the function parsing g. The
+// accumulator is only passed when it carries a value.
+func (c *compiler) params(g *Node) []*Node {
+	if g.acc != nil && g.ntype != nil {
+		return append([]*Node{g.acc}, c.needs[g]...)
 	}
-	fmt.Fprintf(codeout, ")\n")
-	fmt.Fprintf(codeout, "\n")
+	return c.needs[g]
 }
 
-func lexerDump(top *Node) {
+func (c *compiler) codeDump(top *Node) {
+	c.topDump(top)
+	c.lexerDump(top)
+	c.parserDump(top)
+}
+
+// tokenConv maps the type of a regdef to the body of a function that
+// converts the text of a token, lit, into its value. A regdef of type
+// *ZbToken has the token itself as value, for actions needing its
+// position.
+var tokenConv = map[string]string{
+	"*ZbToken": "return tok, nil",
+	"string":  "return lit, nil",
+	"[]byte":  "return []byte(lit), nil",
+	"bool":    "return strconv.ParseBool(lit)",
+	"int":     "return strconv.Atoi(lit)",
+	"int8":    "v, err := strconv.ParseInt(lit, 10, 8)\nreturn int8(v), err",
+	"int16":   "v, err := strconv.ParseInt(lit, 10, 16)\nreturn int16(v), err",
+	"int32":   "v, err := strconv.ParseInt(lit, 10, 32)\nreturn int32(v), err",
+	"int64":   "return strconv.ParseInt(lit, 10, 64)",
+	"uint":    "v, err := strconv.ParseUint(lit, 10, 0)\nreturn uint(v), err",
+	"uint8":   "v, err := strconv.ParseUint(lit, 10, 8)\nreturn uint8(v), err",
+	"byte":    "v, err := strconv.ParseUint(lit, 10, 8)\nreturn byte(v), err",
+	"uint16":  "v, err := strconv.ParseUint(lit, 10, 16)\nreturn uint16(v), err",
+	"uint32":  "v, err := strconv.ParseUint(lit, 10, 32)\nreturn uint32(v), err",
+	"uint64":  "return strconv.ParseUint(lit, 10, 64)",
+	"float32": "v, err := strconv.ParseFloat(lit, 32)\nreturn float32(v), err",
+	"float64": "return strconv.ParseFloat(lit, 64)",
+}
+
+func (c *compiler) topDump(top *Node) {
+	fmt.Fprintf(c.codeout, "// Code generated by zebu from grammar %s. DO NOT EDIT.\n", top.sym)
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 1. Package clause, taken from the supplied code when it has one
+	code := string(top.code)
+	fset := token.NewFileSet()
+	have := make(map[string]bool)
+	var specs []string
+	if f, err := parser.ParseFile(fset, "", code, parser.ImportsOnly); err == nil {
+		fmt.Fprintf(c.codeout, "package %s\n", f.Name)
+		code = code[fset.Position(f.Name.End()).Offset:]
+		for _, spec := range f.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			have[path] = true
+		}
+	} else {
+		fmt.Fprintf(c.codeout, "package %s\n", top.sym)
+	}
+	fmt.Fprintf(c.codeout, "\n")
+
+	// Code supplied by imported grammars goes into the same file, their
+	// package clause is dropped and their imports are merged with ours.
+	seen := make(map[string]bool)
+	for _, g := range c.grammars {
+		if !g.imported || g.top == nil || len(g.top.code) == 0 || seen[g.file] {
+			continue
+		}
+		seen[g.file] = true
+		code1 := string(g.top.code)
+		fset1 := token.NewFileSet()
+		f, err := parser.ParseFile(fset1, "", code1, parser.ImportsOnly)
+		if err != nil {
+			code += "\n" + code1
+			continue
+		}
+		end := fset1.Position(f.Name.End()).Offset
+		if len(f.Imports) != 0 {
+			end = fset1.Position(f.Decls[len(f.Decls)-1].End()).Offset
+			for _, spec := range f.Imports {
+				path, _ := strconv.Unquote(spec.Path.Value)
+				if !have[path] {
+					have[path] = true
+					specs = append(specs, code1[fset1.Position(spec.Pos()).Offset:fset1.Position(spec.End()).Offset])
+				}
+			}
+		}
+		code += "\n" + code1[end:]
+	}
+
+	// 2. Add imports required by our generated code, leaving out the
+	// ones the supplied code already has
+	fmt.Fprintf(c.codeout, "import (\n")
+	for _, v := range c.imports {
+		if !have[v] {
+			fmt.Fprintf(c.codeout, "\"%s\"\n", v)
+		}
+	}
+	for _, v := range specs {
+		fmt.Fprintf(c.codeout, "%s\n", v)
+	}
+	fmt.Fprintf(c.codeout, ")\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 3. Dump the rest of the supplied code
+	if len(code) != 0 {
+		fmt.Fprintf(c.codeout, "%s\n", code)
+	}
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+func (c *compiler) lexerDump(top *Node) {
 	// 1. Lexer types
-	fmt.Fprintf(codeout, "// Lexing\n")
-	fmt.Fprintf(codeout, "type ZbTokenKind int\n")
+	fmt.Fprintf(c.codeout, "// Lexing\n")
+	fmt.Fprintf(c.codeout, "type ZbTokenKind int\n")
 
-	fmt.Fprintf(codeout, "const (\n")
-	fmt.Fprintf(codeout, "ZBEOF = iota\n")
-	fmt.Fprintf(codeout, "ZBUNKNOWN = 0 - iota\n")
-	// TODO : We will table this for use later
-	for _, n := range top.nodes {
-		if n.op != OREGDEF {
+	// Single character literals use their character as kind, every other
+	// token gets a named negative kind.
+	fmt.Fprintf(c.codeout, "const (\n")
+	fmt.Fprintf(c.codeout, "ZBEOF ZbTokenKind = iota\n")
+	fmt.Fprintf(c.codeout, "ZBUNKNOWN ZbTokenKind = 0 - iota\n")
+	for _, n := range c.lexdfa.toks {
+		if n.op == OSTRLIT && len(n.lit.lit) == 1 {
 			continue
 		}
-		fmt.Fprintf(codeout, "ZB%s\n", n.sym)
+		fmt.Fprintf(c.codeout, "%s\n", c.caseFriendly(n))
+	}
+	fmt.Fprintf(c.codeout, ")\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// Tokens are named in errors as in the grammar
+	fmt.Fprintf(c.codeout, "var zbTokenNames = map[ZbTokenKind]string{\n")
+	fmt.Fprintf(c.codeout, "ZBEOF: \"end of input\",\n")
+	for _, n := range c.lexdfa.toks {
+		fmt.Fprintf(c.codeout, "%s: %s,\n", c.caseFriendly(n), strconv.Quote(tokString(n)))
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// ZbToken is a token of the input.\n")
+	fmt.Fprintf(c.codeout, "type ZbToken struct {\n")
+	fmt.Fprintf(c.codeout, "pos token.Position\n")
+	fmt.Fprintf(c.codeout, "kind ZbTokenKind\n")
+	fmt.Fprintf(c.codeout, "lit string\n")
+	fmt.Fprintf(c.codeout, "val interface{}\n")
+	if _, hidden := c.lexHidden(); len(hidden) > 0 {
+		fmt.Fprintf(c.codeout, "hidden []*ZbToken // tokens of hidden regdefs right before this one\n")
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// Syntax errors are told apart from errors reading the input, which
+	// end the parse.
+	fmt.Fprintf(c.codeout, "// ZbError is a syntax error of the input.\n")
+	fmt.Fprintf(c.codeout, "type ZbError struct {\n")
+	fmt.Fprintf(c.codeout, "Pos token.Position\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Found is what was found at Pos: a token, quoted as in the grammar,\n")
+	fmt.Fprintf(c.codeout, "// end of input, or a character no token starts with.\n")
+	fmt.Fprintf(c.codeout, "Found string\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Expected are the tokens that could have come instead, named as in\n")
+	fmt.Fprintf(c.codeout, "// the grammar and sorted, empty when the lexer found the error.\n")
+	fmt.Fprintf(c.codeout, "Expected []string\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Err is why the value of the token found could not be converted,\n")
+	fmt.Fprintf(c.codeout, "// when that is the error.\n")
+	fmt.Fprintf(c.codeout, "Err error\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "func (e *ZbError) Error() string {\n")
+	fmt.Fprintf(c.codeout, "switch {\n")
+	fmt.Fprintf(c.codeout, "case e.Err != nil:\n")
+	fmt.Fprintf(c.codeout, "return fmt.Sprintf(\"%%s: %%v\", e.Pos, e.Err)\n")
+	fmt.Fprintf(c.codeout, "case len(e.Expected) == 0:\n")
+	fmt.Fprintf(c.codeout, "return fmt.Sprintf(\"%%s: unexpected %%s\", e.Pos, e.Found)\n")
+	fmt.Fprintf(c.codeout, "case len(e.Expected) == 1:\n")
+	fmt.Fprintf(c.codeout, "return fmt.Sprintf(\"%%s: expected %%s, found %%s\", e.Pos, e.Expected[0], e.Found)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return fmt.Sprintf(\"%%s: expected one of %%s, found %%s\", e.Pos, strings.Join(e.Expected, \", \"), e.Found)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "func (e *ZbError) Unwrap() error {\n")
+	fmt.Fprintf(c.codeout, "return e.Err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// Pos returns the position of the first character of tok.\n")
+	fmt.Fprintf(c.codeout, "func (tok *ZbToken) Pos() token.Position {\n")
+	fmt.Fprintf(c.codeout, "return tok.pos\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Kind returns the kind of tok, ZBEOF at the end of the input.\n")
+	fmt.Fprintf(c.codeout, "func (tok *ZbToken) Kind() ZbTokenKind {\n")
+	fmt.Fprintf(c.codeout, "return tok.kind\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Text returns the text of tok as it is in the input.\n")
+	fmt.Fprintf(c.codeout, "func (tok *ZbToken) Text() string {\n")
+	fmt.Fprintf(c.codeout, "return tok.lit\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Value returns the value of tok, its text converted to the type of its\n")
+	fmt.Fprintf(c.codeout, "// regdef.\n")
+	fmt.Fprintf(c.codeout, "func (tok *ZbToken) Value() interface{} {\n")
+	fmt.Fprintf(c.codeout, "return tok.val\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	if _, hidden := c.lexHidden(); len(hidden) > 0 {
+		fmt.Fprintf(c.codeout, "// Hidden returns the tokens of hidden regdefs right before tok, such as\n")
+		fmt.Fprintf(c.codeout, "// comments, in the order of the input.\n")
+		fmt.Fprintf(c.codeout, "func (tok *ZbToken) Hidden() []*ZbToken {\n")
+		fmt.Fprintf(c.codeout, "return tok.hidden\n")
+		fmt.Fprintf(c.codeout, "}\n")
+		fmt.Fprintf(c.codeout, "\n")
+	}
+
+	fmt.Fprintf(c.codeout, "// found names tok in errors.\n")
+	fmt.Fprintf(c.codeout, "func (tok *ZbToken) found() string {\n")
+	fmt.Fprintf(c.codeout, "if tok.kind == ZBEOF {\n")
+	fmt.Fprintf(c.codeout, "return zbTokenNames[ZBEOF]\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return \"'\" + strings.ReplaceAll(tok.lit, \"\\n\", `\\n`) + \"'\"\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "type ZbLexer struct {\n")
+	fmt.Fprintf(c.codeout, "buf *bufio.Reader\n")
+	fmt.Fprintf(c.codeout, "pos token.Position // position of the next byte\n")
+	fmt.Fprintf(c.codeout, "file *token.File // file the lines are added to, if any\n")
+	fmt.Fprintf(c.codeout, "back []byte // bytes read past the end of the last token\n")
+	if c.lexModes() {
+		fmt.Fprintf(c.codeout, "mode int // lexer mode\n")
+		fmt.Fprintf(c.codeout, "modes []int // modes to pop back to, the last pushed last\n")
+	}
+	if _, hidden := c.lexHidden(); len(hidden) > 0 {
+		fmt.Fprintf(c.codeout, "hidden []*ZbToken // hidden tokens read since the last token\n")
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 2. DFA tables
+	fmt.Fprintf(c.codeout, "type zbLexEdge struct {\n")
+	fmt.Fprintf(c.codeout, "lo, hi rune\n")
+	fmt.Fprintf(c.codeout, "next int\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbLexTrans = [...][]zbLexEdge{\n")
+	for _, s := range c.lexdfa.states {
+		fmt.Fprintf(c.codeout, "{")
+		for i, e := range s.edges {
+			if i > 0 {
+				fmt.Fprintf(c.codeout, ", ")
+			}
+			fmt.Fprintf(c.codeout, "{%d, %d, %d}", e.r.lo, e.r.hi, e.to)
+		}
+		fmt.Fprintf(c.codeout, "},\n")
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	if c.lexModes() {
+		fmt.Fprintf(c.codeout, "// Lexer modes\n")
+		fmt.Fprintf(c.codeout, "const (\n")
+		for i, mode := range c.lexdfa.modes {
+			if i == 0 {
+				fmt.Fprintf(c.codeout, "zbMode%s = iota\n", mode)
+			} else {
+				fmt.Fprintf(c.codeout, "zbMode%s\n", mode)
+			}
+		}
+		fmt.Fprintf(c.codeout, ")\n")
+		fmt.Fprintf(c.codeout, "\n")
+
+		fmt.Fprintf(c.codeout, "// zbLexStart is the start state of each mode\n")
+		fmt.Fprintf(c.codeout, "var zbLexStart = [...]int{")
+		for i, s := range c.lexdfa.starts {
+			if i > 0 {
+				fmt.Fprintf(c.codeout, ", ")
+			}
+			fmt.Fprintf(c.codeout, "%d", s)
+		}
+		fmt.Fprintf(c.codeout, "}\n")
+		fmt.Fprintf(c.codeout, "\n")
+	}
+
+	fmt.Fprintf(c.codeout, "var zbLexAccept = [...]ZbTokenKind{\n")
+	for _, s := range c.lexdfa.states {
+		if s.tok == nil {
+			fmt.Fprintf(c.codeout, "ZBUNKNOWN,\n")
+		} else {
+			fmt.Fprintf(c.codeout, "%s,\n", c.caseFriendly(s.tok))
+		}
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// Keywords are not part of the DFA, a match of the regdef owning a
+	// keyword is looked up in this table instead.
+	if len(c.lexdfa.keywords) > 0 {
+		fmt.Fprintf(c.codeout, "var zbLexKeywords = map[ZbTokenKind]map[string]ZbTokenKind{\n")
+		for _, r := range c.lexdfa.toks {
+			if r.op != OREGDEF {
+				continue
+			}
+			started := false
+			for _, k := range c.lexdfa.toks {
+				if c.lexdfa.keywords[k] != r {
+					continue
+				}
+				if !started {
+					fmt.Fprintf(c.codeout, "%s: {\n", c.caseFriendly(r))
+					started = true
+				}
+				fmt.Fprintf(c.codeout, "%s: %s,\n", strconv.Quote(k.lit.lit), c.caseFriendly(k))
+			}
+			if started {
+				fmt.Fprintf(c.codeout, "},\n")
+			}
+		}
+		fmt.Fprintf(c.codeout, "}\n")
+		fmt.Fprintf(c.codeout, "\n")
 	}
-	fmt.Fprintf(codeout, ")\n")
-	fmt.Fprintf(codeout, "\n")
 
-	fmt.Fprintf(codeout, "type ZbToken struct {\n")
-	fmt.Fprintf(codeout, "pos int\n")
-	fmt.Fprintf(codeout, "kind ZbTokenKind\n")
-	fmt.Fprintf(codeout, "val interface{}\n")
-	fmt.Fprintf(codeout, "}\n")
+	// 3. Lexer code
+	fmt.Fprintf(c.codeout, "func consZbLexer(buf *bufio.Reader) *ZbLexer {\n")
+	fmt.Fprintf(c.codeout, "return &ZbLexer {\n")
+	fmt.Fprintf(c.codeout, "buf: buf,\n")
+	fmt.Fprintf(c.codeout, "pos: token.Position{Line: 1, Column: 1},\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
 
-	fmt.Fprintf(codeout, "type ZbLexer struct {\n")
-	fmt.Fprintf(codeout, "buf *bufio.Reader\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "\n")
+	fmt.Fprintf(c.codeout, "// consume moves the position of l past the bytes b.\n")
+	fmt.Fprintf(c.codeout, "func (l *ZbLexer) consume(b []byte) {\n")
+	fmt.Fprintf(c.codeout, "for _, c := range b {\n")
+	fmt.Fprintf(c.codeout, "l.pos.Offset++\n")
+	fmt.Fprintf(c.codeout, "l.pos.Column++\n")
+	fmt.Fprintf(c.codeout, "if c == '\\n' {\n")
+	fmt.Fprintf(c.codeout, "l.pos.Line++\n")
+	fmt.Fprintf(c.codeout, "l.pos.Column = 1\n")
+	fmt.Fprintf(c.codeout, "if l.file != nil {\n")
+	fmt.Fprintf(c.codeout, "l.file.AddLine(l.pos.Offset)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// The input is UTF-8, a byte that is not part of a valid encoding
+	// reads as utf8.RuneError.
+	fmt.Fprintf(c.codeout, "// readRune returns the next character of the input and its encoding.\n")
+	fmt.Fprintf(c.codeout, "func (l *ZbLexer) readRune() (c rune, b []byte, err error) {\n")
+	fmt.Fprintf(c.codeout, "for !utf8.FullRune(l.back) {\n")
+	fmt.Fprintf(c.codeout, "var c1 byte\n")
+	fmt.Fprintf(c.codeout, "if c1, err = l.buf.ReadByte(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "if len(l.back) == 0 {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "err = nil\n")
+	fmt.Fprintf(c.codeout, "break\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "l.back = append(l.back, c1)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "c, n := utf8.DecodeRune(l.back)\n")
+	fmt.Fprintf(c.codeout, "b, l.back = l.back[:n:n], l.back[n:]\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	if c.lexModes() {
+		c.lexCmdsDump()
+	}
+
+	fmt.Fprintf(c.codeout, "func zbTokenValue(tok *ZbToken) (interface{}, error) {\n")
+	fmt.Fprintf(c.codeout, "lit := tok.lit\n")
+	fmt.Fprintf(c.codeout, "switch tok.kind {\n")
+	for _, n := range c.lexdfa.toks {
+		if n.op != OREGDEF || n.ntype == nil {
+			continue
+		}
+		fmt.Fprintf(c.codeout, "case %s:\n", c.caseFriendly(n))
+		fmt.Fprintf(c.codeout, "%s\n", tokenConv[n.ntype.typ])
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return lit, nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
 
-	// 2. Lexer code
-	fmt.Fprintf(codeout, "func consZbLexer(buf *bufio.Reader) *ZbLexer {\n")
-	fmt.Fprintf(codeout, "return &ZbLexer {\n")
-	fmt.Fprintf(codeout, "buf: buf,\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "\n")
+	// The edges of a state are sorted and Unicode classes make many of
+	// them, so they are searched by halves.
+	fmt.Fprintf(c.codeout, "func zbLexStep(state int, c rune) int {\n")
+	fmt.Fprintf(c.codeout, "edges := zbLexTrans[state]\n")
+	fmt.Fprintf(c.codeout, "i := sort.Search(len(edges), func(i int) bool { return c <= edges[i].hi })\n")
+	fmt.Fprintf(c.codeout, "if i < len(edges) && edges[i].lo <= c {\n")
+	fmt.Fprintf(c.codeout, "return edges[i].next\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return -1\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
 
-	fmt.Fprintf(codeout, "func (l *ZbLexer) next() (tok *Token, err error) {\n")
-	fmt.Fprintf(codeout, "return\n")
-	fmt.Fprintf(codeout, "}\n")
+	// Maximal munch: run the DFA until it dies, remembering the last
+	// accepting state, then hand back everything read past it. With
+	// skipped or hidden regdefs next is left to lexHiddenDump, which
+	// calls this function for each token.
+	skip, hidden := c.lexHidden()
+	if len(skip) > 0 || len(hidden) > 0 {
+		c.lexHiddenDump()
+		fmt.Fprintf(c.codeout, "func (l *ZbLexer) scan() (tok *ZbToken, err error) {\n")
+	} else {
+		fmt.Fprintf(c.codeout, "func (l *ZbLexer) next() (tok *ZbToken, err error) {\n")
+	}
+	fmt.Fprintf(c.codeout, "lexeme := make([]byte, 0, 16)\n")
+	if c.lexModes() {
+		fmt.Fprintf(c.codeout, "state, last, kind := zbLexStart[l.mode], 0, ZBUNKNOWN\n")
+	} else {
+		fmt.Fprintf(c.codeout, "state, last, kind := 0, 0, ZBUNKNOWN\n")
+	}
+	fmt.Fprintf(c.codeout, "for {\n")
+	fmt.Fprintf(c.codeout, "c, b, rerr := l.readRune()\n")
+	fmt.Fprintf(c.codeout, "if rerr == io.EOF {\n")
+	fmt.Fprintf(c.codeout, "break\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if rerr != nil {\n")
+	fmt.Fprintf(c.codeout, "return nil, rerr\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "lexeme = append(lexeme, b...)\n")
+	fmt.Fprintf(c.codeout, "if state = zbLexStep(state, c); state < 0 {\n")
+	fmt.Fprintf(c.codeout, "break\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if zbLexAccept[state] != ZBUNKNOWN {\n")
+	fmt.Fprintf(c.codeout, "last, kind = len(lexeme), zbLexAccept[state]\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if len(lexeme) == 0 {\n")
+	fmt.Fprintf(c.codeout, "return &ZbToken{pos: l.pos, kind: ZBEOF}, nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if kind == ZBUNKNOWN {\n")
+	fmt.Fprintf(c.codeout, "// Skip the offending character so the next call makes progress\n")
+	fmt.Fprintf(c.codeout, "c, n := utf8.DecodeRune(lexeme)\n")
+	fmt.Fprintf(c.codeout, "l.back = append(lexeme[n:len(lexeme):len(lexeme)], l.back...)\n")
+	fmt.Fprintf(c.codeout, "found := fmt.Sprintf(\"character %%q\", c)\n")
+	fmt.Fprintf(c.codeout, "if c == utf8.RuneError && n == 1 {\n")
+	fmt.Fprintf(c.codeout, "found = fmt.Sprintf(\"invalid UTF-8 byte %%#x\", lexeme[0])\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "err = &ZbError{Pos: l.pos, Found: found}\n")
+	fmt.Fprintf(c.codeout, "l.consume(lexeme[:n])\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "l.back = append(lexeme[last:len(lexeme):len(lexeme)], l.back...)\n")
+	if c.lexModes() {
+		fmt.Fprintf(c.codeout, "l.command(kind)\n")
+	}
+	if len(c.lexdfa.keywords) > 0 {
+		fmt.Fprintf(c.codeout, "if kw, ok := zbLexKeywords[kind][string(lexeme[:last])]; ok {\n")
+		fmt.Fprintf(c.codeout, "kind = kw\n")
+		fmt.Fprintf(c.codeout, "}\n")
+	}
+	fmt.Fprintf(c.codeout, "tok = &ZbToken{pos: l.pos, kind: kind, lit: string(lexeme[:last])}\n")
+	fmt.Fprintf(c.codeout, "l.consume(lexeme[:last])\n")
+	fmt.Fprintf(c.codeout, "if tok.val, err = zbTokenValue(tok); err != nil {\n")
+	fmt.Fprintf(c.codeout, "err = &ZbError{Pos: tok.pos, Found: tok.found(), Err: err}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
 }
 
 func genFriendly(sym *Sym) string {
 	s := ""
-	b := sym.name[0]
-	if b >= 'a' && b <= 'z' {
-		b = 'A' + (b - 'a')
+	if sym.gram != nil && sym.gram.imported {
+		s = genFriendly(&Sym{name: sym.gram.name}) + "_"
 	}
-	s += string(b)
-	for i := 1; i < len(sym.name); i++ {
-		if sym.name[i] == '\'' {
+	for i := 0; i < len(sym.name); i++ {
+		b := sym.name[i]
+		switch {
+		case b == '\'':
 			s += "Prime"
-		} else {
-			s += string(sym.name[i])
+		case i == 0 && b >= 'a' && b <= 'z':
+			s += string('A' + (b - 'a'))
+		default:
+			s += string(b)
 		}
 	}
 	return s
 }
 
-func callFriendly(n *Node) string {
-	return fmt.Sprintf("parse%s()", genFriendly(n.sym))
+func callFriendly(n *Node, args ...string) string {
+	return fmt.Sprintf("p.parse%s(%s)", genFriendly(n.sym), strings.Join(args, ", "))
 }
 
-func caseFriendly(n *Node) string {
+func (c *compiler) caseFriendly(n *Node) string {
 	switch n.op {
 	case OSTRLIT:
-		return fmt.Sprintf("'%s'", n.lit.lit)
+		if len(n.lit.lit) == 1 {
+			return strconv.QuoteRune(rune(n.lit.lit[0]))
+		}
+		return fmt.Sprintf("ZBLIT%d", c.lexdfa.prio[n])
 	case OREGDEF:
+		if n.sym.gram != nil && n.sym.gram.imported {
+			return fmt.Sprintf("ZB%s_%s", n.sym.gram, n.sym)
+		}
 		return fmt.Sprintf("ZB%s", n.sym)
 	default:
 		panic(fmt.Sprintf("unexpected node op %s during caseFriendly\n", n.op))
 	}
 }
 
-func firstFriendly(n *Node) map[*Node]bool {
+func (c *compiler) firstFriendly(n *Node) map[*Node]bool {
 	switch n.op {
 	case ORULE:
-		return first[n]
+		return c.first[n]
 	case OREGDEF, OSTRLIT:
 		return map[*Node]bool{n: true}
+	case OEPSILON:
+		return map[*Node]bool{nepsilon: true}
 	default:
 		panic(fmt.Sprintf("unexpected op %s in firstFriendly\n", n.op))
 	}
 }
 
-func parserDump(top *Node) {
+// prodFirst returns the tokens that can begin prod, in lexer priority
+// order, and whether prod can derive the empty string.
+func (c *compiler) prodFirst(prod *Node) (toks []*Node, nullable bool) {
+	set := make(map[*Node]bool)
+	nullable = true
+	for _, elem := range prod.nodes {
+		fst := c.firstFriendly(elem.left)
+		for k := range fst {
+			if k != nepsilon {
+				set[k] = true
+			}
+		}
+		if !fst[nepsilon] {
+			nullable = false
+			break
+		}
+	}
+	toks = make([]*Node, 0, len(set))
+	for k := range set {
+		toks = append(toks, k)
+	}
+	sort.Slice(toks, func(i, j int) bool {
+		return c.lexdfa.prio[toks[i]] < c.lexdfa.prio[toks[j]]
+	})
+	return
+}
+
+// lexModes reports whether the lexer has modes to switch between.
+func (c *compiler) lexModes() bool {
+	if len(c.lexdfa.modes) > 1 {
+		return true
+	}
+	for _, tok := range c.lexdfa.toks {
+		if tok.op == OREGDEF && changesMode(tok) {
+			return true
+		}
+	}
+	return false
+}
+
+// changesMode reports whether the regdef n has commands changing the mode.
+func changesMode(n *Node) bool {
+	for _, cmd := range n.cmds {
+		if cmd.op == "push" || cmd.op == "pop" || cmd.op == "switch" {
+			return true
+		}
+	}
+	return false
+}
+
+// lexHidden returns the tokens of the skipped regdefs and of the hidden
+// ones, which the lexer does not hand to the parser.
+func (c *compiler) lexHidden() (skip, hidden []*Node) {
+	for _, tok := range c.lexdfa.toks {
+		switch {
+		case tok.op != OREGDEF:
+		case hiddenBy(tok) == "skip":
+			skip = append(skip, tok)
+		case hiddenBy(tok) == "hidden":
+			hidden = append(hidden, tok)
+		}
+	}
+	return
+}
+
+// lexHiddenDump writes next, which runs the DFA until it finds a token
+// for the parser. Skipped tokens are dropped, and hidden ones are kept
+// with the token after them.
+func (c *compiler) lexHiddenDump() {
+	skip, hidden := c.lexHidden()
+	kinds := func(l []*Node) string {
+		s := make([]string, len(l))
+		for i, tok := range l {
+			s[i] = c.caseFriendly(tok)
+		}
+		return strings.Join(s, ", ")
+	}
+	fmt.Fprintf(c.codeout, "func (l *ZbLexer) next() (tok *ZbToken, err error) {\n")
+	fmt.Fprintf(c.codeout, "for {\n")
+	fmt.Fprintf(c.codeout, "if tok, err = l.scan(); tok == nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "switch tok.kind {\n")
+	if len(skip) > 0 {
+		fmt.Fprintf(c.codeout, "case %s:\n", kinds(skip))
+	}
+	if len(hidden) > 0 {
+		fmt.Fprintf(c.codeout, "case %s:\n", kinds(hidden))
+		fmt.Fprintf(c.codeout, "l.hidden = append(l.hidden, tok)\n")
+	}
+	fmt.Fprintf(c.codeout, "default:\n")
+	if len(hidden) > 0 {
+		fmt.Fprintf(c.codeout, "tok.hidden, l.hidden = l.hidden, nil\n")
+	}
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "// The value of a token the parser does not get is still checked\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "return nil, err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// lexCmdsDump writes command, which runs the commands of the regdef
+// matched by a token of kind on the mode stack.
+func (c *compiler) lexCmdsDump() {
+	fmt.Fprintf(c.codeout, "func (l *ZbLexer) command(kind ZbTokenKind) {\n")
+	fmt.Fprintf(c.codeout, "switch kind {\n")
+	for _, tok := range c.lexdfa.toks {
+		if tok.op != OREGDEF || !changesMode(tok) {
+			continue
+		}
+		fmt.Fprintf(c.codeout, "case %s:\n", c.caseFriendly(tok))
+		for _, cmd := range tok.cmds {
+			switch cmd.op {
+			case "push":
+				fmt.Fprintf(c.codeout, "l.modes = append(l.modes, l.mode)\n")
+				fmt.Fprintf(c.codeout, "l.mode = zbMode%s\n", cmd.mode)
+			case "pop":
+				// Popping the bottom of the stack keeps the mode
+				fmt.Fprintf(c.codeout, "if n := len(l.modes); n > 0 {\n")
+				fmt.Fprintf(c.codeout, "l.mode, l.modes = l.modes[n-1], l.modes[:n-1]\n")
+				fmt.Fprintf(c.codeout, "}\n")
+			case "switch":
+				fmt.Fprintf(c.codeout, "l.mode = zbMode%s\n", cmd.mode)
+			}
+		}
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// followKinds returns the token kinds of the follow set of rule n, in
+// lexer priority order.
+func (c *compiler) followKinds(n *Node) []string {
+	toks := make([]*Node, 0, len(c.follow[n]))
+	for k := range c.follow[n] {
+		if k != nepsilon {
+			toks = append(toks, k)
+		}
+	}
+	sort.Slice(toks, func(i, j int) bool {
+		return c.lexdfa.prio[toks[i]] < c.lexdfa.prio[toks[j]]
+	})
+	kinds := make([]string, len(toks))
+	for i, k := range toks {
+		kinds[i] = c.caseFriendly(k)
+	}
+	return kinds
+}
+
+// syncTableDump writes zbSync, the sync tokens error recovery stops at.
+func (c *compiler) syncTableDump() {
+	fmt.Fprintf(c.codeout, "var zbSync = map[ZbTokenKind]bool{")
+	for i, n := range c.synctoks {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		fmt.Fprintf(c.codeout, "%s: true", c.caseFriendly(n))
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// syncDump writes the error recovery of the LL(1) backends. A rule
+// failing on a syntax error skips input up to a token that can follow
+// it, or past a sync token, and returns as if it had been parsed.
+func (c *compiler) syncDump() {
+	c.syncTableDump()
+	fmt.Fprintf(c.codeout, "// sync recovers from *err, when it is a syntax error, by skipping\n")
+	fmt.Fprintf(c.codeout, "// tokens up to the end of the input or one of follow, or past a sync\n")
+	fmt.Fprintf(c.codeout, "// token.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) sync(err *error, follow ...ZbTokenKind) {\n")
+	fmt.Fprintf(c.codeout, "if _, ok := (*err).(*ZbError); !ok {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "p.report(*err)\n")
+	fmt.Fprintf(c.codeout, "*err = nil\n")
+	fmt.Fprintf(c.codeout, "for p.lookahead.kind != ZBEOF {\n")
+	fmt.Fprintf(c.codeout, "for _, kind := range follow {\n")
+	fmt.Fprintf(c.codeout, "if p.lookahead.kind == kind {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "stop := zbSync[p.lookahead.kind]\n")
+	fmt.Fprintf(c.codeout, "if *err = p.advance(); *err != nil || stop {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// parseFileDump writes Parse and the start of ParseFile, up to where p,
+// the parser of its input, is ready. The backends write the rest of
+// ParseFile.
+func (c *compiler) parseFileDump(top *Node) {
+	results := "err error"
+	if start := top.left; start.ntype != nil {
+		results = fmt.Sprintf("result %s, err error", start.ntype.typ)
+	}
+	fmt.Fprintf(c.codeout, "// Parse reads a complete %s from r.\n", top.sym)
+	fmt.Fprintf(c.codeout, "func Parse(r io.Reader) (%s) {\n", results)
+	fmt.Fprintf(c.codeout, "return ParseFile(nil, \"\", r)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "// ParseFile reads a complete %s from r, the file filename, which\n", top.sym)
+	fmt.Fprintf(c.codeout, "// is added to fset unless fset is nil. Errors are reported at\n")
+	fmt.Fprintf(c.codeout, "// positions in filename, all of them in a ZbErrorList.\n")
+	fmt.Fprintf(c.codeout, "func ParseFile(fset *token.FileSet, filename string, r io.Reader) (%s) {\n", results)
+	fmt.Fprintf(c.codeout, "p, err := consZbParser(fset, filename, r)\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "defer p.finish(&err)\n")
+}
+
+func (c *compiler) parserDump(top *Node) {
 	// 1. Parser types
-	fmt.Fprintf(codeout, "// Parser\n")
-	fmt.Fprintf(codeout, "type ZbParser struct {\n")
-	fmt.Fprintf(codeout, "lexer *ZbLexer\n")
-	fmt.Fprintf(codeout, "lookahead *ZbToken\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "\n")
+	fmt.Fprintf(c.codeout, "// Parser\n")
+	fmt.Fprintf(c.codeout, "type ZbParser struct {\n")
+	fmt.Fprintf(c.codeout, "lexer *ZbLexer\n")
+	fmt.Fprintf(c.codeout, "lookahead *ZbToken\n")
+	fmt.Fprintf(c.codeout, "errs ZbErrorList // syntax errors found so far\n")
+	fmt.Fprintf(c.codeout, "errtok *ZbToken // lookahead at the last of them\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// ZbErrorList is the list of syntax errors of an input, in the order\n")
+	fmt.Fprintf(c.codeout, "// they were found. A parse returns one when its input has any.\n")
+	fmt.Fprintf(c.codeout, "type ZbErrorList []error\n")
+	fmt.Fprintf(c.codeout, "\n")
+	fmt.Fprintf(c.codeout, "func (l ZbErrorList) Error() string {\n")
+	fmt.Fprintf(c.codeout, "switch len(l) {\n")
+	fmt.Fprintf(c.codeout, "case 0:\n")
+	fmt.Fprintf(c.codeout, "return \"no errors\"\n")
+	fmt.Fprintf(c.codeout, "case 1:\n")
+	fmt.Fprintf(c.codeout, "return l[0].Error()\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return fmt.Sprintf(\"%%s (and %%d more errors)\", l[0], len(l)-1)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
 
 	// 2. Parser code
-	fmt.Fprintf(codeout, "func consZbParser(buf *bufio.Reader) *ZbParser {\n")
-	fmt.Fprintf(codeout, "return &ZbParser {\n")
-	fmt.Fprintf(codeout, "lexer: consZbLexer(buf),\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "\n")
-
-	fmt.Fprintf(codeout, "func (p *ZbParser) expect(kind TokenKind) error {\n")
-	fmt.Fprintf(codeout, "if p.lookahead != kind {\n")
-	fmt.Fprintf(codeout, "fmt.Printf(\"error!\")\n")
-	fmt.Fprintf(codeout, "os.Exit(1)\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "p.lookahead = p.lexer.next()\n")
-	fmt.Fprintf(codeout, "return nil\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "\n")
-
-	// 3. Rule code
+	// Without a file set the input is streamed, with one it is read
+	// whole, as a token.File needs the size of its file.
+	fmt.Fprintf(c.codeout, "// consZbParser returns a parser reading r, known as filename in\n")
+	fmt.Fprintf(c.codeout, "// positions. Unless fset is nil, r is added to it as a file.\n")
+	fmt.Fprintf(c.codeout, "func consZbParser(fset *token.FileSet, filename string, r io.Reader) (*ZbParser, error) {\n")
+	fmt.Fprintf(c.codeout, "l := consZbLexer(bufio.NewReader(r))\n")
+	fmt.Fprintf(c.codeout, "l.pos.Filename = filename\n")
+	fmt.Fprintf(c.codeout, "if fset != nil {\n")
+	fmt.Fprintf(c.codeout, "src, err := io.ReadAll(r)\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "return nil, err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "l.buf = bufio.NewReader(bytes.NewReader(src))\n")
+	fmt.Fprintf(c.codeout, "l.file = fset.AddFile(filename, -1, len(src))\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return &ZbParser{lexer: l}, nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// The lexer skips what it cannot match, so its syntax errors are
+	// only recorded.
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) advance() (err error) {\n")
+	fmt.Fprintf(c.codeout, "for {\n")
+	fmt.Fprintf(c.codeout, "var tok *ZbToken\n")
+	fmt.Fprintf(c.codeout, "tok, err = p.lexer.next()\n")
+	fmt.Fprintf(c.codeout, "if tok != nil {\n")
+	fmt.Fprintf(c.codeout, "p.lookahead = tok\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if _, ok := err.(*ZbError); ok {\n")
+	fmt.Fprintf(c.codeout, "p.errs = append(p.errs, err)\n")
+	fmt.Fprintf(c.codeout, "err = nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if tok != nil || err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// unexpected returns the error of finding the lookahead instead of one\n")
+	fmt.Fprintf(c.codeout, "// of the tokens of expected.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) unexpected(expected ...ZbTokenKind) error {\n")
+	fmt.Fprintf(c.codeout, "err := &ZbError{Pos: p.lookahead.pos, Found: p.lookahead.found()}\n")
+	fmt.Fprintf(c.codeout, "seen := make(map[ZbTokenKind]bool)\n")
+	fmt.Fprintf(c.codeout, "for _, kind := range expected {\n")
+	fmt.Fprintf(c.codeout, "if !seen[kind] {\n")
+	fmt.Fprintf(c.codeout, "err.Expected = append(err.Expected, zbTokenNames[kind])\n")
+	fmt.Fprintf(c.codeout, "seen[kind] = true\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "sort.Strings(err.Expected)\n")
+	fmt.Fprintf(c.codeout, "return err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// report adds err, a syntax error at the lookahead, to the errors of\n")
+	fmt.Fprintf(c.codeout, "// the input, unless the last one is at the same token: err most likely\n")
+	fmt.Fprintf(c.codeout, "// follows from it.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) report(err error) {\n")
+	fmt.Fprintf(c.codeout, "if p.lookahead != p.errtok {\n")
+	fmt.Fprintf(c.codeout, "p.errs = append(p.errs, err)\n")
+	fmt.Fprintf(c.codeout, "p.errtok = p.lookahead\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// finish sets *err, the error the parse ended with, to the syntax\n")
+	fmt.Fprintf(c.codeout, "// errors of the input when it has any. An error reading the input is\n")
+	fmt.Fprintf(c.codeout, "// kept as is.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) finish(err *error) {\n")
+	fmt.Fprintf(c.codeout, "if _, ok := (*err).(*ZbError); ok {\n")
+	fmt.Fprintf(c.codeout, "p.report(*err)\n")
+	fmt.Fprintf(c.codeout, "*err = nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if *err == nil && len(p.errs) > 0 {\n")
+	fmt.Fprintf(c.codeout, "*err = p.errs\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) expect(kind ZbTokenKind) (tok *ZbToken, err error) {\n")
+	fmt.Fprintf(c.codeout, "if p.lookahead.kind != kind {\n")
+	fmt.Fprintf(c.codeout, "err = p.unexpected(kind)\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "tok = p.lookahead\n")
+	fmt.Fprintf(c.codeout, "err = p.advance()\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	switch c.backend {
+	case "rd", "table":
+		c.syncDump()
+	case "lalr":
+		c.syncTableDump()
+	}
+	switch c.backend {
+	case "table":
+		c.tableDump(top)
+		return
+	case "lalr":
+		c.lalrDump(top)
+		return
+	case "earley":
+		c.earleyDump(top)
+		return
+	}
+
+	start := top.left
+	c.parseFileDump(top)
+	fmt.Fprintf(c.codeout, "if err = p.advance(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "if result, err = %s; err != nil {\n", callFriendly(start))
+	} else {
+		fmt.Fprintf(c.codeout, "if err = %s; err != nil {\n", callFriendly(start))
+	}
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if p.lookahead.kind != ZBEOF {\n")
+	fmt.Fprintf(c.codeout, "err = p.unexpected(ZBEOF)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 3. Rule code, actions are spliced into the rules using them
 	for _, n := range top.nodes {
-		if n.op != ORULE {
+		if n.op != ORULE || actionOf(n) != nil {
 			continue
 		}
-		ruleDump(n)
+		c.ruleDump(n)
 	}
 }
 
-func ruleDump(n *Node) {
-	fmt.Fprintf(codeout, "func (p *ZbParser) parse%s() ", genFriendly(n.sym))
+func (c *compiler) ruleDump(n *Node) {
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) parse%s(", genFriendly(n.sym))
+	for i, d := range c.params(n) {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		typ, _ := dclType(d)
+		fmt.Fprintf(c.codeout, "%s %s", c.dclName(d), typ)
+	}
 	if n.ntype != nil {
-		fmt.Fprintf(codeout, "(result %s, err error) {\n", n.ntype.typ)
+		fmt.Fprintf(c.codeout, ") (result %s, err error) {\n", n.ntype.typ)
 	} else {
-		fmt.Fprintf(codeout, "(err error) {\n")
+		fmt.Fprintf(c.codeout, ") (err error) {\n")
 	}
+	follow := append([]string{"&err"}, c.followKinds(n)...)
+	fmt.Fprintf(c.codeout, "defer p.sync(%s)\n", strings.Join(follow, ", "))
 
-	// 3.1. Switch for all productions
-	hasepsilon := false
-	fmt.Fprintf(codeout, "switch p.lookahead {\n")
+	// 3.1. Locals holding the values of elements used by actions
+	tokused := false
 	for _, prod := range n.nodes {
-		n1 := prod.nodes[0]
-		if n1.left.op == OEPSILON {
-			hasepsilon = true
-			continue
-		}
-		firsts := firstFriendly(n1.left)
-		fmt.Fprintf(codeout, "case ")
-		prev := false
-		for n1, _ := range firsts {
-			if prev {
-				fmt.Fprintf(codeout, ", %s", caseFriendly(n1))
-			} else {
-				fmt.Fprintf(codeout, "%s", caseFriendly(n1))
-				prev = true
+		for _, elem := range prod.nodes {
+			if !c.elemUsed(elem) {
+				continue
+			}
+			typ, _ := dclType(elem)
+			fmt.Fprintf(c.codeout, "var %s %s\n", c.dclName(elem), typ)
+			if elem.left.op != ORULE {
+				tokused = true
 			}
 		}
-		fmt.Fprintf(codeout, ":\n")
+	}
+	if tokused {
+		fmt.Fprintf(c.codeout, "var tok *ZbToken\n")
+	}
 
-		// 3.2. Production code
-		for _, n1 := range prod.nodes {
-			switch n1.left.op {
-			case OSTRLIT, OREGDEF:
-				fmt.Fprintf(codeout, "expect(%s)\n", caseFriendly(n1.left))
-			case ORULE:
-				fmt.Fprintf(codeout, "%s\n", callFriendly(n1.left))
+	// 3.2. Switch for all productions. A nullable production is chosen
+	// whenever no other production applies, so it becomes the default.
+	var nullprod *Node
+	var expected []string
+	fmt.Fprintf(c.codeout, "switch p.lookahead.kind {\n")
+	for _, prod := range n.nodes {
+		firsts, nullable := c.prodFirst(prod)
+		if nullable && nullprod == nil {
+			nullprod = prod
+			continue
+		}
+		if len(firsts) == 0 {
+			continue
+		}
+		for _, n1 := range firsts {
+			expected = append(expected, c.caseFriendly(n1))
+		}
+		fmt.Fprintf(c.codeout, "case ")
+		for i, n1 := range firsts {
+			if i > 0 {
+				fmt.Fprintf(c.codeout, ", ")
 			}
+			fmt.Fprintf(c.codeout, "%s", c.caseFriendly(n1))
 		}
+		fmt.Fprintf(c.codeout, ":\n")
+		c.prodDump(n, prod)
 	}
 
 	// 3.x. Default and End Switch
-	fmt.Fprintf(codeout, "default:\n")
-	if hasepsilon {
-		fmt.Fprintf(codeout, "// epsilon\n")
-		fmt.Fprintf(codeout, "return\n")
+	fmt.Fprintf(c.codeout, "default:\n")
+	if nullprod != nil {
+		c.prodDump(n, nullprod)
 	} else {
-		fmt.Fprintf(codeout, "fmt.Printf(\"error!\")\n")
-		fmt.Fprintf(codeout, "os.Exit(1)\n")
+		fmt.Fprintf(c.codeout, "err = p.unexpected(%s)\n", strings.Join(expected, ", "))
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// elemUsed reports whether the value of elem is needed by an action.
+func (c *compiler) elemUsed(elem *Node) bool {
+	if _, ok := dclType(elem); !ok {
+		return false
+	}
+	_, ok := c.dclids[elem]
+	return ok
+}
+
+// dclValue returns the Go expression for the value of d at element i of
+// prod in rule g. assigned tells whether $$ was set earlier in prod.
+func (c *compiler) dclValue(g *Node, prod *Node, i int, d *Node, assigned bool) string {
+	switch {
+	case isLocal(prod, i, d):
+		return c.dclName(d)
+	case g.acc == d && assigned, c.isAccOwner(g, d):
+		return "result"
+	}
+	return c.dclName(d)
+}
+
+// 3.3. Production code
+func (c *compiler) prodDump(g *Node, prod *Node) {
+	assigned := false
+	if g.acc != nil && g.ntype != nil && len(prod.nodes) == 1 && prod.nodes[0].left.op == OEPSILON {
+		// Nothing more to the left recursion, the result is what
+		// has been parsed so far
+		fmt.Fprintf(c.codeout, "result = %s\n", c.dclName(g.acc))
+	}
+	for i, n1 := range prod.nodes {
+		e := n1.left
+		if a := actionOf(e); a != nil {
+			c.actionDump(g, prod, i, a, assigned)
+			assigned = true
+			continue
+		}
+		switch e.op {
+		case OSTRLIT, OREGDEF:
+			if c.elemUsed(n1) {
+				typ, _ := dclType(n1)
+				fmt.Fprintf(c.codeout, "if tok, err = p.expect(%s); err != nil {\n", c.caseFriendly(e))
+				fmt.Fprintf(c.codeout, "return\n")
+				fmt.Fprintf(c.codeout, "}\n")
+				fmt.Fprintf(c.codeout, "%s, _ = tok.val.(%s)\n", c.dclName(n1), typ)
+				continue
+			}
+			fmt.Fprintf(c.codeout, "if _, err = p.expect(%s); err != nil {\n", c.caseFriendly(e))
+		case ORULE:
+			args := make([]string, 0)
+			for _, d := range c.params(e) {
+				args = append(args, c.dclValue(g, prod, i, d, assigned))
+			}
+			call := callFriendly(e, args...)
+			switch {
+			case e.orig != nil && e.ntype != nil && e.root() == g.root():
+				// Derived from the same rule, it finishes parsing
+				// our result
+				fmt.Fprintf(c.codeout, "if result, err = %s; err != nil {\n", call)
+				assigned = true
+			case e.ntype != nil && c.elemUsed(n1):
+				fmt.Fprintf(c.codeout, "if %s, err = %s; err != nil {\n", c.dclName(n1), call)
+			case e.ntype != nil:
+				fmt.Fprintf(c.codeout, "if _, err = %s; err != nil {\n", call)
+			default:
+				fmt.Fprintf(c.codeout, "if err = %s; err != nil {\n", call)
+			}
+		default:
+			continue
+		}
+		fmt.Fprintf(c.codeout, "return\n")
+		fmt.Fprintf(c.codeout, "}\n")
 	}
-	fmt.Fprintf(codeout, "}\n")
+}
 
-	fmt.Fprintf(codeout, "return\n")
-	fmt.Fprintf(codeout, "}\n")
-	fmt.Fprintf(codeout, "\n")
+// actionDump splices the code of an action into the rule, replacing $$
+// with the rule result and every other variable id with the value of
+// the element it refers to.
+func (c *compiler) actionDump(g *Node, prod *Node, i int, a *Node, assigned bool) {
+	buf, _ := c.actionText(g, prod, i, a, assigned)
+	fmt.Fprintf(c.codeout, "if len(p.errs) == 0 {\n%s\n}\n", buf)
+}
 
+// actionText returns the code of an action with its variable ids
+// replaced, and the element values it reads, nil standing for the rule
+// result. Variable ids are found exactly the way parseAction found them,
+// so the k-th one matches a.dpn[k].
+func (c *compiler) actionText(g *Node, prod *Node, i int, a *Node, assigned bool) (buf []byte, refs []*Node) {
+	code := a.code
+	buf = make([]byte, 0, len(code))
+	k := 0
+	for j := 0; j < len(code); j++ {
+		if code[j] != '$' {
+			buf = append(buf, code[j])
+			continue
+		}
+		e := j + 1
+		for e < len(code) && isVarIdChar(rune(code[e])) {
+			e++
+		}
+		var d *Node
+		v := "result"
+		if string(code[j:e]) != "$$" {
+			d = a.dpn[k]
+			v = c.dclValue(g, prod, i, d, assigned)
+			k++
+		}
+		if v == "result" {
+			d = nil
+		}
+		if !hasDcl(refs, d) {
+			refs = append(refs, d)
+		}
+		buf = append(buf, v...)
+		j = e - 1
+	}
+	return
 }
 
 // Code Generated
@@ -343,19 +1378,21 @@ func ruleDump(n *Node) {
 //   buf *bufio.Reader
 // }
 // func consZbLexer(buf *bufio.Reader) *ZbLexer { }
-// func (l *ZbLexer) next() (tok *Token, err error) { }
+// func (l *ZbLexer) next() (tok *ZbToken, err error) { }
 
 // Parser
 // type ZbParser struct {
 //   lexer *ZbLexer
-//	 lookahead *ZbToken
+//   lookahead *ZbToken
 // }
 
-// func consZbParser(buf *bufio.Reader) *ZbParser { }
-// func (p *ZbParser) expect(kind ZbTokenKind) (err error) {
-//   if p.lookahead != kind {
-//     fmt.Printf("error!")
-//     os.Exit(1)
-//	 }
-//   p.lookahead, _ = p.lexer.next()
-//}
+// func Parse(r io.Reader) (err error) { }
+// func consZbParser(r io.Reader) *ZbParser { }
+// func (p *ZbParser) expect(kind ZbTokenKind) (tok *ZbToken, err error) {
+//   if p.lookahead.kind != kind {
+//     return nil, p.unexpected(kind)
+//   }
+//   tok = p.lookahead
+//   err = p.advance()
+//   return
+// }
@@ -0,0 +1,38 @@
+// gen_test.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// The generated code is checked in and marked DO NOT EDIT, so compiling
+// the same grammar again must give the same bytes.
+
+// reproBackends are the backends whose output is compared.
+var reproBackends = []string{"rd", "table", "lalr", "earley"}
+
+func TestReproducible(t *testing.T) {
+	files, _ := filepath.Glob("../test/*.zb")
+	for _, backend := range reproBackends {
+		for _, file := range files {
+			res, err := Compile(nil, file, Options{Backend: backend})
+			if err != nil {
+				continue
+			}
+			for i := 0; i < 10; i++ {
+				res1, err := Compile(nil, file, Options{Backend: backend})
+				if err != nil {
+					t.Fatalf("%s -backend=%s: %v", file, backend, err)
+				}
+				if !bytes.Equal(res.Code, res1.Code) {
+					t.Errorf("%s -backend=%s: code differs from one compilation to the next", file, backend)
+					break
+				}
+			}
+		}
+	}
+}
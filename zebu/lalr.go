@@ -0,0 +1,657 @@
+// lalr.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The LALR(1) backend works on the grammar as written, without the left
+// factoring and left recursion removal the LL(1) backends need. The LR(0)
+// item sets are built first, then lookaheads are computed by spontaneous
+// generation and propagation (the Dragon book's algorithm 4.63) and the
+// ACTION and GOTO tables are filled in from the result.
+//
+// An action at the end of a production runs when the production is
+// reduced. An action in the middle of a production stays an empty rule of
+// its own, reduced when the parser gets to it, and reads the values to its
+// left from below the top of the value stack. $$ is carried from one
+// action of a production to the next through the values of these rules.
+
+// lrProd is a production of the LR grammar. Production 0 is the augmented
+// start production.
+type lrProd struct {
+	rule *Node   // left hand side, nil for production 0
+	prod *Node   // production of rule
+	rhs  []*Node // grammar symbols
+	code *Node   // trailing action rule, run on reduce
+}
+
+type lrItem struct {
+	prod int
+	dot  int
+}
+
+type lrState struct {
+	kernel []lrItem
+	la     map[lrItem]map[*Node]bool // lookaheads of the kernel items
+	next   map[*Node]int             // transitions on grammar symbols
+	action map[*Node]int             // > 0 shift to action-1, < 0 reduce -action-1
+}
+
+type LALR struct {
+	c        *compiler
+	prods    []*lrProd
+	byRule   map[*Node][]int
+	nullable map[*Node]bool
+	first    map[*Node]map[*Node]bool
+	states   []*lrState
+	rules    []*Node       // nonterminals, in GOTO order
+	index    map[*Node]int // index of each nonterminal
+}
+
+// Lookahead sentinels: the end of the input, and the probe used to find
+// which lookaheads propagate.
+var lrEOF = &Node{op: OXXX}
+var lrProbe = &Node{op: OXXX}
+
+// lrTrailing reports whether the element elem, found at index i of prod,
+// is an action run when prod is reduced.
+func lrTrailing(prod *Node, i int) bool {
+	return i == len(prod.nodes)-1 && actionOf(prod.nodes[i].left) != nil
+}
+
+func lrSymbols(prod *Node) (rhs []*Node, code *Node) {
+	for i, elem := range prod.nodes {
+		switch {
+		case elem.left.op == OEPSILON:
+		case lrTrailing(prod, i):
+			code = elem.left
+		default:
+			rhs = append(rhs, elem.left)
+		}
+	}
+	return
+}
+
+func (c *compiler) buildLALR(top *Node) (t *LALR) {
+	t = lrGrammar(top)
+	t.c = c
+	t.buildStates()
+	t.buildLookaheads()
+	t.buildActions()
+	return
+}
+
+// lrGrammar collects the productions of the grammar as written, with
+// their first sets. It is shared with the Earley backend.
+func lrGrammar(top *Node) (t *LALR) {
+	t = &LALR{
+		byRule:   make(map[*Node][]int),
+		nullable: make(map[*Node]bool),
+		first:    make(map[*Node]map[*Node]bool),
+		index:    make(map[*Node]int),
+	}
+
+	// 1. Productions. Trailing action rules are folded into the
+	// production they end.
+	trailing := make(map[*Node]bool)
+	for _, dcl := range top.nodes {
+		if dcl.op != ORULE {
+			continue
+		}
+		for _, prod := range dcl.nodes {
+			if _, code := lrSymbols(prod); code != nil {
+				trailing[code] = true
+			}
+		}
+	}
+	t.prods = append(t.prods, &lrProd{rhs: []*Node{top.left}})
+	for _, dcl := range top.nodes {
+		if dcl.op != ORULE || trailing[dcl] {
+			continue
+		}
+		t.index[dcl] = len(t.rules)
+		t.rules = append(t.rules, dcl)
+		for _, prod := range dcl.nodes {
+			rhs, code := lrSymbols(prod)
+			t.byRule[dcl] = append(t.byRule[dcl], len(t.prods))
+			t.prods = append(t.prods, &lrProd{rule: dcl, prod: prod, rhs: rhs, code: code})
+		}
+	}
+
+	t.buildFirst()
+	return
+}
+
+// buildFirst computes which rules derive the empty string and the
+// terminals starting each rule.
+func (t *LALR) buildFirst() {
+	for _, r := range t.rules {
+		t.first[r] = make(map[*Node]bool)
+	}
+	changed := true
+	for changed {
+		changed = false
+		for _, p := range t.prods[1:] {
+			f, nullable := t.firstSeq(p.rhs)
+			for a := range f {
+				if !t.first[p.rule][a] {
+					t.first[p.rule][a] = true
+					changed = true
+				}
+			}
+			if nullable && !t.nullable[p.rule] {
+				t.nullable[p.rule] = true
+				changed = true
+			}
+		}
+	}
+}
+
+// firstSeq returns the terminals starting syms and whether syms derive
+// the empty string.
+func (t *LALR) firstSeq(syms []*Node) (f map[*Node]bool, nullable bool) {
+	f = make(map[*Node]bool)
+	for _, s := range syms {
+		if s.op != ORULE {
+			f[s] = true
+			return
+		}
+		for a := range t.first[s] {
+			f[a] = true
+		}
+		if !t.nullable[s] {
+			return
+		}
+	}
+	nullable = true
+	return
+}
+
+func (t *LALR) closure(kernel []lrItem) []lrItem {
+	in := make(map[lrItem]bool)
+	items := make([]lrItem, 0, len(kernel))
+	for _, it := range kernel {
+		in[it] = true
+		items = append(items, it)
+	}
+	for i := 0; i < len(items); i++ {
+		p := t.prods[items[i].prod]
+		if items[i].dot == len(p.rhs) || p.rhs[items[i].dot].op != ORULE {
+			continue
+		}
+		for _, q := range t.byRule[p.rhs[items[i].dot]] {
+			it := lrItem{q, 0}
+			if !in[it] {
+				in[it] = true
+				items = append(items, it)
+			}
+		}
+	}
+	return items
+}
+
+func itemsKey(items []lrItem) string {
+	var b strings.Builder
+	for _, it := range items {
+		fmt.Fprintf(&b, "%d.%d,", it.prod, it.dot)
+	}
+	return b.String()
+}
+
+// buildStates builds the canonical collection of LR(0) item sets.
+func (t *LALR) buildStates() {
+	seen := make(map[string]int)
+	add := func(kernel []lrItem) int {
+		sort.Slice(kernel, func(i, j int) bool {
+			if kernel[i].prod == kernel[j].prod {
+				return kernel[i].dot < kernel[j].dot
+			}
+			return kernel[i].prod < kernel[j].prod
+		})
+		key := itemsKey(kernel)
+		if id, ok := seen[key]; ok {
+			return id
+		}
+		seen[key] = len(t.states)
+		t.states = append(t.states, &lrState{
+			kernel: kernel,
+			la:     make(map[lrItem]map[*Node]bool),
+			next:   make(map[*Node]int),
+			action: make(map[*Node]int),
+		})
+		return len(t.states) - 1
+	}
+
+	add([]lrItem{{0, 0}})
+	for i := 0; i < len(t.states); i++ {
+		s := t.states[i]
+		// Group the items moving over each symbol, in order of
+		// first appearance
+		syms := make([]*Node, 0)
+		moved := make(map[*Node][]lrItem)
+		for _, it := range t.closure(s.kernel) {
+			p := t.prods[it.prod]
+			if it.dot == len(p.rhs) {
+				continue
+			}
+			x := p.rhs[it.dot]
+			if moved[x] == nil {
+				syms = append(syms, x)
+			}
+			moved[x] = append(moved[x], lrItem{it.prod, it.dot + 1})
+		}
+		for _, x := range syms {
+			s.next[x] = add(moved[x])
+		}
+	}
+}
+
+// closure1 is the LR(1) closure of items, each with a set of lookaheads.
+func (t *LALR) closure1(items map[lrItem]map[*Node]bool) {
+	work := make([]lrItem, 0, len(items))
+	for it := range items {
+		work = append(work, it)
+	}
+	for len(work) > 0 {
+		it := work[len(work)-1]
+		work = work[:len(work)-1]
+		p := t.prods[it.prod]
+		if it.dot == len(p.rhs) || p.rhs[it.dot].op != ORULE {
+			continue
+		}
+		la, nullable := t.firstSeq(p.rhs[it.dot+1:])
+		if nullable {
+			for a := range items[it] {
+				la[a] = true
+			}
+		}
+		for _, q := range t.byRule[p.rhs[it.dot]] {
+			it1 := lrItem{q, 0}
+			if items[it1] == nil {
+				items[it1] = make(map[*Node]bool)
+			}
+			changed := false
+			for a := range la {
+				if !items[it1][a] {
+					items[it1][a] = true
+					changed = true
+				}
+			}
+			if changed {
+				work = append(work, it1)
+			}
+		}
+	}
+}
+
+type lrLink struct {
+	state int
+	item  lrItem
+}
+
+// buildLookaheads finds the lookaheads of every kernel item.
+func (t *LALR) buildLookaheads() {
+	for _, s := range t.states {
+		for _, it := range s.kernel {
+			s.la[it] = make(map[*Node]bool)
+		}
+	}
+	t.states[0].la[lrItem{0, 0}][lrEOF] = true
+
+	// 1. Lookaheads generated spontaneously, and the kernel items they
+	// propagate to.
+	prop := make(map[lrLink][]lrLink)
+	for i, s := range t.states {
+		for _, k := range s.kernel {
+			items := map[lrItem]map[*Node]bool{k: {lrProbe: true}}
+			t.closure1(items)
+			for it, la := range items {
+				p := t.prods[it.prod]
+				if it.dot == len(p.rhs) {
+					continue
+				}
+				to := lrLink{s.next[p.rhs[it.dot]], lrItem{it.prod, it.dot + 1}}
+				for a := range la {
+					if a == lrProbe {
+						prop[lrLink{i, k}] = append(prop[lrLink{i, k}], to)
+					} else {
+						t.states[to.state].la[to.item][a] = true
+					}
+				}
+			}
+		}
+	}
+
+	// 2. Propagate until nothing changes
+	changed := true
+	for changed {
+		changed = false
+		for from, tos := range prop {
+			for a := range t.states[from.state].la[from.item] {
+				for _, to := range tos {
+					if !t.states[to.state].la[to.item][a] {
+						t.states[to.state].la[to.item][a] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// buildActions fills in the ACTION table and reports its conflicts.
+// Shift/reduce conflicts are resolved by shifting, reduce/reduce conflicts
+// are errors.
+func (t *LALR) buildActions() {
+	for _, s := range t.states {
+		for x, to := range s.next {
+			if x.op != ORULE {
+				s.action[x] = to + 1
+			}
+		}
+
+		items := make(map[lrItem]map[*Node]bool)
+		for it, la := range s.la {
+			items[it] = make(map[*Node]bool)
+			for a := range la {
+				items[it][a] = true
+			}
+		}
+		t.closure1(items)
+
+		reduces := make([]lrItem, 0)
+		for it := range items {
+			if it.dot == len(t.prods[it.prod].rhs) {
+				reduces = append(reduces, it)
+			}
+		}
+		sort.Slice(reduces, func(i, j int) bool { return reduces[i].prod < reduces[j].prod })
+		for _, it := range reduces {
+			p := t.prods[it.prod]
+			las := make([]*Node, 0, len(items[it]))
+			for a := range items[it] {
+				las = append(las, a)
+			}
+			sort.Slice(las, func(i, j int) bool { return lrName(las[i]) < lrName(las[j]) })
+			for _, a := range las {
+				act, ok := s.action[a]
+				switch {
+				case !ok:
+					s.action[a] = -it.prod - 1
+				case act > 0:
+					t.c.compileWarning(p.rule.pos, "shift/reduce conflict in %s on %s, resolved as shift.", p.rule.root().sym, lrName(a))
+				case act != -it.prod-1:
+					q := t.prods[-act-1]
+					t.c.compileError(p.rule.pos, "reduce/reduce conflict between %s and %s on %s.", q.rule.root().sym, p.rule.root().sym, lrName(a))
+				}
+			}
+		}
+	}
+}
+
+func lrName(a *Node) string {
+	switch {
+	case a == lrEOF:
+		return "end of input"
+	case a.op == OSTRLIT:
+		return fmt.Sprintf("'%s'", escapeStrlit(a.lit.lit))
+	}
+	return a.sym.name
+}
+
+func (c *compiler) lalrDump(top *Node) {
+	t := c.lalrtab
+	start := top.left
+
+	// 1. Tables
+	fmt.Fprintf(c.codeout, "var zbLRAction = [...]map[ZbTokenKind]int{\n")
+	for i, s := range t.states {
+		keys := make([]*Node, 0, len(s.action))
+		for a := range s.action {
+			keys = append(keys, a)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i] == lrEOF || keys[j] == lrEOF {
+				return keys[i] == lrEOF
+			}
+			return c.lexdfa.prio[keys[i]] < c.lexdfa.prio[keys[j]]
+		})
+		fmt.Fprintf(c.codeout, "{")
+		for _, a := range keys {
+			kind := "ZBEOF"
+			if a != lrEOF {
+				kind = c.caseFriendly(a)
+			}
+			fmt.Fprintf(c.codeout, "%s: %d, ", kind, s.action[a])
+		}
+		fmt.Fprintf(c.codeout, "}, // %d\n", i)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbLRGoto = [...]map[int]int{\n")
+	for _, s := range t.states {
+		fmt.Fprintf(c.codeout, "{")
+		for _, r := range t.rules {
+			if to, ok := s.next[r]; ok {
+				fmt.Fprintf(c.codeout, "%d: %d, ", t.index[r], to)
+			}
+		}
+		fmt.Fprintf(c.codeout, "},\n")
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "// Rule and length of every production\n")
+	fmt.Fprintf(c.codeout, "var zbLRProds = [...][2]int{")
+	for i, p := range t.prods {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		lhs := -1
+		if p.rule != nil {
+			lhs = t.index[p.rule]
+		}
+		fmt.Fprintf(c.codeout, "{%d, %d}", lhs, len(p.rhs))
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 2. Parse, the shift-reduce driver
+	c.parseFileDump(top)
+	fmt.Fprintf(c.codeout, "if err = p.advance(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "states := []int{0}\n")
+	fmt.Fprintf(c.codeout, "vals := []interface{}{nil}\n")
+	fmt.Fprintf(c.codeout, "// Tokens shifted, up to the last error\n")
+	fmt.Fprintf(c.codeout, "shifts, errShifts := 0, -1\n")
+	fmt.Fprintf(c.codeout, "for {\n")
+	fmt.Fprintf(c.codeout, "act, ok := zbLRAction[states[len(states)-1]][p.lookahead.kind]\n")
+	fmt.Fprintf(c.codeout, "switch {\n")
+	fmt.Fprintf(c.codeout, "case !ok:\n")
+	fmt.Fprintf(c.codeout, "var expected []ZbTokenKind\n")
+	fmt.Fprintf(c.codeout, "for kind := range zbLRAction[states[len(states)-1]] {\n")
+	fmt.Fprintf(c.codeout, "expected = append(expected, kind)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "p.report(p.unexpected(expected...))\n")
+	fmt.Fprintf(c.codeout, "// Without a shift since the last error, the lookahead is skipped\n")
+	fmt.Fprintf(c.codeout, "// for the parse to go on\n")
+	fmt.Fprintf(c.codeout, "skip := len(zbSync) > 0 || shifts == errShifts\n")
+	fmt.Fprintf(c.codeout, "errShifts = shifts\n")
+	fmt.Fprintf(c.codeout, "if states, vals, err = p.recover(states, vals, skip); err != nil || states == nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "case act > 0:\n")
+	fmt.Fprintf(c.codeout, "shifts++\n")
+	fmt.Fprintf(c.codeout, "states = append(states, act-1)\n")
+	fmt.Fprintf(c.codeout, "vals = append(vals, p.lookahead.val)\n")
+	fmt.Fprintf(c.codeout, "if err = p.advance(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "case act == -1:\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "result, _ = vals[len(vals)-1].(%s)\n", start.ntype.typ)
+	}
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "default:\n")
+	fmt.Fprintf(c.codeout, "prod := -act - 1\n")
+	fmt.Fprintf(c.codeout, "var v interface{}\n")
+	fmt.Fprintf(c.codeout, "if v, err = p.reduce(prod, vals); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "n := len(states) - zbLRProds[prod][1]\n")
+	fmt.Fprintf(c.codeout, "states, vals = states[:n], vals[:n]\n")
+	fmt.Fprintf(c.codeout, "states = append(states, zbLRGoto[states[n-1]][zbLRProds[prod][0]])\n")
+	fmt.Fprintf(c.codeout, "vals = append(vals, v)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 3. Error recovery, panic mode on the stack of states
+	fmt.Fprintf(c.codeout, "// recover resumes the parse after a syntax error. It skips the input\n")
+	fmt.Fprintf(c.codeout, "// up to a token that can follow a rule of a state on the stack, which\n")
+	fmt.Fprintf(c.codeout, "// the skipped input stands for, and pops the states above it. With\n")
+	fmt.Fprintf(c.codeout, "// sync tokens, only the token after a sync token is tried, and skip\n")
+	fmt.Fprintf(c.codeout, "// skips the lookahead before the first try. It returns the stacks to\n")
+	fmt.Fprintf(c.codeout, "// go on with, nil when the input ends first.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) recover(states []int, vals []interface{}, skip bool) ([]int, []interface{}, error) {\n")
+	fmt.Fprintf(c.codeout, "for {\n")
+	fmt.Fprintf(c.codeout, "for n := len(states); n > 0 && !skip; n-- {\n")
+	fmt.Fprintf(c.codeout, "rules := make([]int, 0, len(zbLRGoto[states[n-1]]))\n")
+	fmt.Fprintf(c.codeout, "for rule := range zbLRGoto[states[n-1]] {\n")
+	fmt.Fprintf(c.codeout, "rules = append(rules, rule)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "sort.Ints(rules)\n")
+	fmt.Fprintf(c.codeout, "for _, rule := range rules {\n")
+	fmt.Fprintf(c.codeout, "to := zbLRGoto[states[n-1]][rule]\n")
+	fmt.Fprintf(c.codeout, "if _, ok := zbLRAction[to][p.lookahead.kind]; ok {\n")
+	fmt.Fprintf(c.codeout, "return append(states[:n], to), append(vals[:n], nil), nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if p.lookahead.kind == ZBEOF {\n")
+	fmt.Fprintf(c.codeout, "return nil, nil, nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "skip = len(zbSync) > 0 && !zbSync[p.lookahead.kind]\n")
+	fmt.Fprintf(c.codeout, "if err := p.advance(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return nil, nil, err\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 4. Reductions running actions
+	c.reduceDump(t, top)
+}
+
+// reduceDump writes the reduce method running the action of a production
+// of t once its values are on the value stack.
+func (c *compiler) reduceDump(t *LALR, top *Node) {
+	sites := make(map[*Node]lrSite)
+	for _, dcl := range top.nodes {
+		if dcl.op != ORULE {
+			continue
+		}
+		for _, prod := range dcl.nodes {
+			for i, elem := range prod.nodes {
+				if actionOf(elem.left) != nil {
+					sites[elem.left] = lrSite{dcl, prod, i}
+				}
+			}
+		}
+	}
+	fmt.Fprintf(c.codeout, "// reduce returns the value of production prod, whose values are on top\n")
+	fmt.Fprintf(c.codeout, "// of vals.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) reduce(prod int, vals []interface{}) (result interface{}, err error) {\n")
+	fmt.Fprintf(c.codeout, "// After a syntax error the values are not to be trusted\n")
+	fmt.Fprintf(c.codeout, "if len(p.errs) > 0 {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "switch prod {\n")
+	for k, p := range t.prods[1:] {
+		c.lrReduceDump(k+1, p, sites)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// lrSite is where an action is written: element i of prod in rule g.
+type lrSite struct {
+	g, prod *Node
+	i       int
+}
+
+// lrPos returns the number of grammar symbols before element i of prod,
+// which is where the value of element i sits on the value stack.
+func lrPos(prod *Node, i int) (n int) {
+	for _, elem := range prod.nodes[:i] {
+		if elem.left.op != OEPSILON {
+			n++
+		}
+	}
+	return
+}
+
+// lrReduceDump writes the reduction of production k, if it does more
+// than leave nil on the value stack.
+func (c *compiler) lrReduceDump(k int, p *lrProd, sites map[*Node]lrSite) {
+	var a *Node
+	var s lrSite
+	var base int // symbols on the stack belonging to s.prod
+	switch {
+	case p.code != nil:
+		a = actionOf(p.code)
+		s = lrSite{p.rule, p.prod, len(p.prod.nodes) - 1}
+		base = len(p.rhs)
+	case actionOf(p.rule) != nil:
+		a = actionOf(p.rule)
+		s = sites[p.rule]
+		base = lrPos(s.prod, s.i)
+	default:
+		// The value of the rule is what its last action left
+		for j := len(p.prod.nodes) - 1; j >= 0; j-- {
+			if actionOf(p.prod.nodes[j].left) != nil {
+				fmt.Fprintf(c.codeout, "case %d: // %s\n", k, p.rule.sym)
+				fmt.Fprintf(c.codeout, "result = vals[len(vals)-%d]\n", len(p.rhs)-lrPos(p.prod, j))
+				return
+			}
+		}
+		return
+	}
+
+	fmt.Fprintf(c.codeout, "case %d: // %s\n", k, s.g.sym)
+	if s.g.ntype != nil {
+		fmt.Fprintf(c.codeout, "var result %s\n", s.g.ntype.typ)
+		for j := s.i - 1; j >= 0; j-- {
+			if actionOf(s.prod.nodes[j].left) != nil {
+				fmt.Fprintf(c.codeout, "result, _ = vals[len(vals)-%d].(%s)\n", base-lrPos(s.prod, j), s.g.ntype.typ)
+				break
+			}
+		}
+	}
+	buf, refs := c.actionText(s.g, s.prod, s.i, a, true)
+	for _, d := range refs {
+		if d == nil {
+			continue
+		}
+		for j, elem := range s.prod.nodes {
+			if elem == d {
+				typ, _ := dclType(d)
+				fmt.Fprintf(c.codeout, "%s, _ := vals[len(vals)-%d].(%s)\n", c.dclName(d), base-lrPos(s.prod, j), typ)
+			}
+		}
+	}
+	fmt.Fprintf(c.codeout, "{\n%s\n}\n", buf)
+	if s.g.ntype != nil {
+		fmt.Fprintf(c.codeout, "return result, err\n")
+	}
+}
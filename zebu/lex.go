@@ -3,8 +3,10 @@ package zebu
 import (
 	"bufio"
 	"fmt"
-	"os"
+	"io"
 	"strconv"
+	"unicode"
+	"unicode/utf8"
 )
 
 type TokenKind int
@@ -22,12 +24,14 @@ const (
 	CHARLIT
 	STRLIT
 	REGLIT
+	REGCAT
 	NUMLIT
 
 	// Keyword tokens
 	GRAMMAR
 	IMPORT
 	KEYWORD
+	SYNC
 	EXTEND
 	INHERIT
 	OVERRIDE
@@ -51,12 +55,14 @@ var tokenLabels = map[TokenKind]string{
 	CHARLIT:     "charlit",
 	STRLIT:      "strlit",
 	REGLIT:      "reglit",
+	REGCAT:      "regcat",
 	NUMLIT:      "numlit",
 
 	// Keyword tokens
 	GRAMMAR:  "grammar",
 	IMPORT:   "import",
 	KEYWORD:  "keyword",
+	SYNC:     "sync",
 	EXTEND:   "extend",
 	INHERIT:  "inherit",
 	OVERRIDE: "override",
@@ -70,7 +76,7 @@ func (k TokenKind) String() string {
 	if int(k) < len(tokenLabels) {
 		return tokenLabels[k]
 	} else {
-		return string(k)
+		return string(rune(k))
 	}
 }
 
@@ -78,6 +84,11 @@ type Position struct {
 	file string
 	line int
 	col  int
+
+	// Byte offsets of the start of the token and of the first byte
+	// after it
+	off int
+	end int
 }
 
 func (p *Position) String() string {
@@ -91,9 +102,9 @@ type Token struct {
 	// Simulating a union
 	lit  *Strlit
 	nval int
-	byt  byte
+	char rune
 	sym  *Sym
-	code []byte
+	code []byte // also the name of a REGCAT, negated when nval is 1
 }
 
 func (t *Token) String() string {
@@ -101,7 +112,12 @@ func (t *Token) String() string {
 	case NAME:
 		return fmt.Sprintf("%s", t.sym)
 	case REGLIT:
-		return fmt.Sprintf("%c", t.byt)
+		return fmt.Sprintf("%c", t.char)
+	case REGCAT:
+		if t.nval == 1 {
+			return fmt.Sprintf("\\P{%s}", t.code)
+		}
+		return fmt.Sprintf("\\p{%s}", t.code)
 	case STRLIT:
 		return fmt.Sprintf("%s", t.lit)
 	case VARID:
@@ -129,36 +145,36 @@ const (
 )
 
 type Lexer struct {
+	c *compiler
+
 	// State based on current loaded file
 	fileName string
-	file     *os.File
 	buf      *bufio.Reader
+	gram     *grammarFile // namespace for the rule and regdef names in this file
 
 	mode LexerMode
 	line int
 	col  int
-
-	// Current char peeked by the lexer
-	ch  byte
-	ch1 byte
+	off  int // bytes read so far
+
+	// Current char peeked by the lexer, its offset and its length in
+	// bytes. Grammars are read as UTF-8.
+	ch    rune
+	choff int
+	chlen int
+	ch1   rune
 }
 
-func consLexer(fileName string) (l *Lexer, err error) {
-	var file *os.File = nil
-	var buf *bufio.Reader = nil
+// consLexer returns a lexer reading the grammar named fileName from r.
+// What it reads is kept for quoting in diagnostics.
+func (c *compiler) consLexer(fileName string, r io.Reader, gram *grammarFile) (l *Lexer) {
+	buf := bufio.NewReader(io.TeeReader(r, c.sourceBuffer(fileName)))
 
-	file, err = os.Open(fileName)
-	if err != nil {
-		return
-	}
-
-	buf = bufio.NewReader(file)
-
-	err = nil
 	l = &Lexer{
+		c:        c,
 		fileName: fileName,
-		file:     file,
 		buf:      buf,
+		gram:     gram,
 		mode:     Normal,
 		line:     1,
 		col:      0,
@@ -173,30 +189,39 @@ func (l *Lexer) getc() {
 	var err error
 	switch l.ch1 {
 	case 0:
-		l.ch, err = l.buf.ReadByte()
+		l.ch, l.chlen, err = l.buf.ReadRune()
+		l.choff = l.off
 		if err != nil {
 			l.ch = 0
+			l.chlen = 1
 			return
 		}
+		l.off += l.chlen
 		if l.ch == '\n' {
 			l.line++
 			l.col = 0
 		} else {
-			l.col++
+			// Columns count bytes, as in go/token
+			l.col += l.chlen
+		}
+		if l.ch == utf8.RuneError && l.chlen == 1 {
+			l.c.compileError(l.pos(), "invalid UTF-8 encoding.")
 		}
 		break
 
 	default:
+		// A char handed back is always the last one read
 		l.ch = l.ch1
 		l.ch1 = 0
+		l.choff = l.off - l.chlen
 	}
 }
 
-func (l *Lexer) putc(b byte) {
-	l.ch1 = b
+func (l *Lexer) putc(c rune) {
+	l.ch1 = c
 }
 
-func isWhitespace(c byte) bool {
+func isWhitespace(c rune) bool {
 	switch c {
 	case ' ', '\n', '\t', '\r':
 		return true
@@ -205,39 +230,93 @@ func isWhitespace(c byte) bool {
 	}
 }
 
-func isAlpha(c byte) bool {
+func isAlpha(c rune) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
 }
 
-func isAlphanum(c byte) bool {
+func isAlphanum(c rune) bool {
 	return isAlpha(c) || isNum(c) || c == '_'
 }
 
-func isNum(c byte) bool {
+func isNum(c rune) bool {
 	return c >= '0' && c <= '9'
 }
 
-func isLower(c byte) bool {
+func isLower(c rune) bool {
 	return c >= 'a' && c <= 'z'
 }
 
-func isUpper(c byte) bool {
+func isUpper(c rune) bool {
 	return c >= 'A' && c <= 'Z'
 }
 
-func isVarId(c byte) bool {
+func isVarId(c rune) bool {
 	return c == '$'
 }
 
-func isVarIdChar(c byte) bool {
+func isVarIdChar(c rune) bool {
 	return c == '$' || isAlphanum(c)
 }
 
-func regEscape(c byte) byte {
-	return c
+func isHex(c rune) bool {
+	return isNum(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// regEscape returns the character of the escape sequence starting at
+// the \ peeked in a character class. A Unicode category or script, as in
+// \p{L}, \pL or \P{Greek}, is returned in t instead, with 0.
+func (l *Lexer) regEscape(t *Token) rune {
+	if l.ch != '\\' {
+		return l.ch
+	}
+	l.getc()
+	switch l.ch {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'u':
+		return l.hexEscape(4)
+	case 'U':
+		return l.hexEscape(8)
+	case 'p', 'P':
+		t.kind = REGCAT
+		if l.ch == 'P' {
+			t.nval = 1
+		}
+		l.getc()
+		if l.ch != '{' {
+			t.code = []byte(string(l.ch))
+			return 0
+		}
+		name := make([]byte, 0, 16)
+		for {
+			l.getc()
+			if l.ch == '}' || l.ch == 0 || isWhitespace(l.ch) {
+				break
+			}
+			name = utf8.AppendRune(name, l.ch)
+		}
+		if l.ch != '}' {
+			l.c.compileError(l.pos(), "unterminated Unicode category, missing }.")
+			l.putc(l.ch)
+		}
+		t.code = name
+		return 0
+	case '\\', '[', ']', '-', '^', ' ':
+		return l.ch
+	case 0:
+		// End of file, left for the caller to report
+		return 0
+	default:
+		l.c.compileError(l.pos(), "unknown escape sequence \\%c in character class.", l.ch)
+		return l.ch
+	}
 }
 
-func (l *Lexer) strEscape() byte {
+func (l *Lexer) strEscape() rune {
 	if l.ch != '\\' {
 		return l.ch
 	}
@@ -245,27 +324,78 @@ func (l *Lexer) strEscape() byte {
 	switch l.ch {
 	case 'n':
 		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'u':
+		return l.hexEscape(4)
+	case 'U':
+		return l.hexEscape(8)
 	case '\\':
 		return '\\'
 	case '\'':
 		return '\''
+	case 0:
+		// End of file, left for the caller to report
+		return 0
 	default:
-		panic(fmt.Sprintf("unknown escape character %c", l.ch))
+		l.c.compileError(l.pos(), "unknown escape sequence \\%c in string literal.", l.ch)
+		return l.ch
+	}
+}
+
+// hexEscape returns the character of the n hex digits following \u or
+// \U, the last char read.
+func (l *Lexer) hexEscape(n int) rune {
+	pos := l.pos()
+	var c rune
+	for i := 0; i < n; i++ {
+		l.getc()
+		if !isHex(l.ch) {
+			l.c.compileError(l.pos(), "invalid escape sequence, expected %d hex digits.", n)
+			l.putc(l.ch)
+			return utf8.RuneError
+		}
+		d, _ := strconv.ParseUint(string(l.ch), 16, 8)
+		c = c<<4 | rune(d)
+	}
+	if c > unicode.MaxRune || (c >= 0xd800 && c < 0xe000) {
+		l.c.compileError(pos, "escape sequence is not a valid Unicode code point.")
+		return utf8.RuneError
+	}
+	return c
+}
+
+// pos returns the position of the character last read.
+func (l *Lexer) pos() *Position {
+	return &Position{
+		file: l.fileName,
+		line: l.line,
+		col:  l.col,
+		off:  l.choff,
+		end:  l.choff + l.chlen,
 	}
 }
 
-func (l *Lexer) raw() byte {
+func (l *Lexer) raw() rune {
 	c := l.ch
 	l.getc()
 	return c
 }
 
+// unraw hands the character peeked by the last call to raw back to the
+// lexer, so the next token starts with it.
+func (l *Lexer) unraw() {
+	l.putc(l.ch)
+}
+
 func (l *Lexer) next() (t *Token) {
 	t = new(Token)
 	var cp int
-	var ep int
 	var lxbuf [512]byte
-	var b byte
+	var long bool
+	var b rune
 
 lex_whitespace:
 	l.getc()
@@ -277,9 +407,10 @@ lex_whitespace:
 		file: l.fileName,
 		line: l.line,
 		col:  l.col,
+		off:  l.choff,
 	}
 	// Update compiler position for better diagnostics
-	zbpos = t.pos
+	l.c.zbpos = t.pos
 
 	// Let's keep mode handling as the prefix to all lexing (minus whitespace)
 	// Easier to jump state once mode is handled
@@ -307,16 +438,14 @@ lex_begin:
 	}
 
 	if isAlpha(l.ch) || l.ch == '$' {
-		lxbuf[0] = l.ch
+		lxbuf[0] = byte(l.ch)
 		cp = 1
-		ep = 512
 		goto lex_alpha
 	}
 
 	if isNum(l.ch) {
-		lxbuf[0] = l.ch
+		lxbuf[0] = byte(l.ch)
 		cp = 1
-		ep = 512
 		goto lex_num
 	}
 
@@ -342,7 +471,7 @@ lex_begin:
 		switch l.ch {
 		case '/':
 			l.getc()
-			for l.ch != '\n' {
+			for l.ch != '\n' && l.ch != 0 {
 				l.getc()
 			}
 			goto lex_whitespace
@@ -350,6 +479,7 @@ lex_begin:
 			for {
 				l.getc()
 				if l.ch == 0 {
+					l.c.compileError(t.pos, "unterminated comment.")
 					goto lex_begin
 				}
 				if l.ch == '*' {
@@ -370,33 +500,42 @@ lex_begin:
 	// This is meant to be the default
 lex_charlit:
 	t.kind = TokenKind(l.ch)
-	t.byt = l.ch
+	t.char = l.ch
 	goto lex_out
 
 lex_alpha:
 	for {
-		if cp+10 >= ep {
-			panic("identifier too long")
-		}
 		l.getc()
 		if !isAlphanum(l.ch) {
 			l.putc(l.ch)
 			break
 		}
-		lxbuf[cp] = l.ch
+		if cp == len(lxbuf) {
+			long = true
+			continue
+		}
+		lxbuf[cp] = byte(l.ch)
 		cp++
 	}
-	t.sym = symbols.lookup(string(lxbuf[:cp]))
+	if long {
+		l.c.compileError(t.pos, "identifier too long.")
+	}
+	t.sym = l.c.symbols.lookup(string(lxbuf[:cp]))
 	t.kind = t.sym.lexical
 	t.sym.pos = t.pos
 	if t.kind == NAME {
-		// Refine the kind to be more specific
+		// Refine the kind to be more specific. Rule and regdef names
+		// belong to the grammar of this file.
 		switch {
-		case isLower(t.sym.name[0]):
+		case isLower(rune(t.sym.name[0])):
 			t.kind = TERMINAL
-		case isUpper(t.sym.name[0]):
+			t.sym = l.c.symbols.lookupGrammar(t.sym.name, l.gram)
+			t.sym.pos = t.pos
+		case isUpper(rune(t.sym.name[0])):
 			t.kind = NONTERMINAL
-		case isVarId(t.sym.name[0]):
+			t.sym = l.c.symbols.lookupGrammar(t.sym.name, l.gram)
+			t.sym.pos = t.pos
+		case isVarId(rune(t.sym.name[0])):
 			t.kind = VARID
 		default:
 			panic("non matching alpha sym")
@@ -406,27 +545,29 @@ lex_alpha:
 
 lex_num:
 	for {
-		if cp+10 >= ep {
-			panic("number too long")
-		}
 		l.getc()
 		if !isNum(l.ch) {
 			l.putc(l.ch)
 			break
 		}
-		lxbuf[cp] = l.ch
+		if cp == len(lxbuf) {
+			long = true
+			continue
+		}
+		lxbuf[cp] = byte(l.ch)
 		cp++
 	}
 	t.kind = NUMLIT
-	t.nval, _ = strconv.Atoi(string(lxbuf[:cp]))
+	if n, err := strconv.Atoi(string(lxbuf[:cp])); err != nil || long {
+		l.c.compileError(t.pos, "number out of range.")
+	} else {
+		t.nval = n
+	}
 	goto lex_out
 
 lex_regex:
-	b = regEscape(l.ch)
-	switch {
-	}
 	t.kind = REGLIT
-	t.byt = b
+	t.char = l.regEscape(t)
 	goto lex_out
 
 lex_strlit:
@@ -435,15 +576,33 @@ lex_strlit:
 		if l.ch == '\'' {
 			break
 		}
-		b := l.strEscape()
-		lxbuf[cp] = b
-		cp++
+		if l.ch == 0 {
+			l.c.compileError(t.pos, "unterminated string literal.")
+			break
+		}
+		b = l.strEscape()
+		if cp+utf8.RuneLen(b) > len(lxbuf) {
+			long = true
+			continue
+		}
+		cp += utf8.EncodeRune(lxbuf[cp:], b)
+	}
+	if long {
+		l.c.compileError(t.pos, "string literal too long.")
 	}
 	t.kind = STRLIT
-	t.lit = strlits.lookup(string(lxbuf[:cp]))
+	t.lit = l.c.strlits.lookup(string(lxbuf[:cp]))
 
 	goto lex_out
 
 lex_out:
+	// The token ends before the char handed back, if any
+	t.pos.end = l.off
+	if l.ch1 != 0 {
+		t.pos.end -= l.chlen
+	}
+	if t.pos.end < t.pos.off {
+		t.pos.end = t.pos.off
+	}
 	return t
 }
@@ -0,0 +1,141 @@
+// lint.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The lint pass looks for parts of a grammar that are legal but most
+// likely mistakes. Each finding is a warning, or an error with -Werror,
+// and each check can be turned off with -W no-<check>.
+
+// lintChecks tells which checks are enabled.
+var lintChecks = map[string]bool{
+	"unused-regdef": true, // regular definitions no rule refers to
+	"unreachable":   true, // rules the start rule cannot reach
+	"unproductive":  true, // rules deriving no string of tokens
+	"unused-varid":  true, // named values no action uses
+}
+
+// lintFlag sets lintChecks from -W check or -W no-check.
+type lintFlag struct{}
+
+func (lintFlag) String() string {
+	l := make([]string, 0, len(lintChecks))
+	for c, on := range lintChecks {
+		if on {
+			l = append(l, c)
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+func (lintFlag) Set(s string) error {
+	on := !strings.HasPrefix(s, "no-")
+	c := strings.TrimPrefix(s, "no-")
+	if c == "all" {
+		for c := range lintChecks {
+			lintChecks[c] = on
+		}
+		return nil
+	}
+	if _, ok := lintChecks[c]; !ok {
+		return fmt.Errorf("unknown check %s", c)
+	}
+	lintChecks[c] = on
+	return nil
+}
+
+func (c *compiler) lintWarning(check string, p *Position, msg string, args ...interface{}) {
+	if !c.checks[check] {
+		return
+	}
+	if c.werror {
+		c.compileError(p, msg, args...)
+		return
+	}
+	c.compileWarning(p, msg, args...)
+}
+
+func (c *compiler) lint(top *Node) {
+	// 1. Regular definitions referred to by rules, or by other regular
+	// definitions. Skipped and hidden ones are used by the lexer alone.
+	used := make(map[*Node]bool)
+	var walk func(n *Node, root bool)
+	walk = func(n *Node, root bool) {
+		if n == nil {
+			return
+		}
+		if !root && (n.op == ORULE || n.op == OREGDEF) {
+			used[n] = true
+			return
+		}
+		walk(n.left, false)
+		walk(n.right, false)
+		for _, n1 := range n.nodes {
+			walk(n1, false)
+		}
+	}
+	for _, dcl := range top.nodes {
+		walk(dcl, true)
+	}
+	for _, dcl := range top.nodes {
+		if dcl.op == OREGDEF && !used[dcl] && hiddenBy(dcl) == "" {
+			c.lintWarning("unused-regdef", dcl.pos, "regular definition %s is never used.", dcl.sym)
+		}
+	}
+
+	// 2. Rules reachable from the start rule
+	reach := reachableRules(top)
+	for _, dcl := range top.nodes {
+		if dcl.op == ORULE && actionOf(dcl) == nil && !reach[dcl] {
+			c.lintWarning("unreachable", dcl.pos, "rule %s is not reachable from %s.", dcl.sym, top.left.sym)
+		}
+	}
+
+	// 3. Rules deriving a string of tokens
+	productive := make(map[*Node]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, dcl := range top.nodes {
+			if dcl.op != ORULE || productive[dcl] {
+				continue
+			}
+		prods:
+			for _, prod := range dcl.nodes {
+				for _, elem := range prod.nodes {
+					if elem.left.op == ORULE && !productive[elem.left] {
+						continue prods
+					}
+				}
+				productive[dcl] = true
+				changed = true
+				break
+			}
+		}
+	}
+	for _, dcl := range top.nodes {
+		if dcl.op == ORULE && !productive[dcl] {
+			c.lintWarning("unproductive", dcl.pos, "rule %s never derives a string of tokens.", dcl.sym)
+		}
+	}
+
+	// 4. Values named with = and never used
+	for _, dcl := range top.nodes {
+		if dcl.op != ORULE || actionOf(dcl) != nil {
+			continue
+		}
+		for _, prod := range dcl.nodes {
+			for _, elem := range prod.nodes {
+				if elem.pos != nil && !elem.used {
+					c.lintWarning("unused-varid", elem.pos, "%s is never used.", elem.sym)
+				}
+			}
+		}
+	}
+}
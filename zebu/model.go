@@ -0,0 +1,313 @@
+// model.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+	"go/token"
+	"sort"
+)
+
+// The grammar model is a read-only copy of a grammar for programs using
+// Compile. It is built from the tree twice: after symbols are resolved,
+// showing the grammar as written with its imports merged in, and after
+// the LL(1) transformations, showing the grammar the parser is generated
+// from. Tokens are named as in a grammar: a regdef by its name, a string
+// literal quoted, as in 'if'.
+
+// Grammar is a grammar and the declarations it uses.
+type Grammar struct {
+	Name     string
+	Pos      token.Position
+	Start    *Rule
+	Rules    []*Rule
+	Regdefs  []*Regdef
+	Keywords []string // reserved words, quoted
+	Sync     []string // tokens error recovery stops at
+}
+
+// Rule is a rule, written in lower case.
+type Rule struct {
+	Name        string
+	Type        string // Go type of the value of the rule, empty if none
+	Pos         token.Position
+	Productions []*Production
+
+	// Origin is the name of the rule the transformations derived the
+	// rule from, empty for a rule of the grammar as written.
+	Origin string
+
+	// Nullable tells whether the rule derives the empty string. First
+	// are the tokens a string derived by the rule can start with, and
+	// Follow the tokens that can come after one, leaving out the end of
+	// the input. Both are sorted.
+	Nullable bool
+	First    []string
+	Follow   []string
+}
+
+// Production is one alternative of a rule.
+type Production struct {
+	Pos      token.Position
+	Elements []*Element
+}
+
+// ElementKind tells what an element of a production refers to.
+type ElementKind int
+
+const (
+	ElemRule    ElementKind = iota // a rule, in Rule
+	ElemRegdef                     // a token of a regdef, in Regdef
+	ElemLiteral                    // a string literal, in Literal
+	ElemEmpty                      // the empty string
+	ElemAction                     // a semantic action, in Action
+)
+
+// Element is an element of a production.
+type Element struct {
+	Kind    ElementKind
+	Var     string // $-name the value of the element is known by in actions
+	Rule    *Rule
+	Regdef  *Regdef
+	Literal string
+	Action  *Action
+}
+
+// Action is a semantic action, the Go code between { and }.
+type Action struct {
+	Code string
+	Pos  token.Position
+	Uses []string // $-names of the values the code refers to
+}
+
+// Regdef is a regular definition, written in upper case.
+type Regdef struct {
+	Name  string
+	Type  string // Go type of the value of its tokens, empty if none
+	Pos   token.Position
+	Regex *RegexNode
+
+	// Mode is the lexer mode the regdef is matched in, empty for the
+	// default mode. Commands are what the lexer does on a match, as
+	// written after ->, such as push(STR), pop or skip.
+	Mode     string
+	Commands []string
+}
+
+// RegexOp is the operator of a node of a regular expression.
+type RegexOp int
+
+const (
+	RegexAlt      RegexOp = iota // one of Children
+	RegexCat                     // Children in sequence
+	RegexStar                    // Children[0] zero or more times
+	RegexPlus                    // Children[0] one or more times
+	RegexRepeat                  // Children[0] Min to Max times, -1 when missing
+	RegexClass                   // one character of Children, or none of them when Negated
+	RegexRange                   // a character from Lo to Hi, in a class
+	RegexChar                    // the character Lo, in a class
+	RegexLiteral                 // the string Literal
+	RegexRegdef                  // the strings of Regdef
+	RegexCategory                // a character of the Unicode category or script Name, or not when Negated
+)
+
+// RegexNode is a node of the regular expression of a regdef.
+type RegexNode struct {
+	Op       RegexOp
+	Children []*RegexNode
+	Lo, Hi   rune
+	Negated  bool
+	Min, Max int
+	Literal  string
+	Regdef   *Regdef
+	Name     string
+}
+
+// modeler builds the model of one tree, making a single object of each
+// declaration however many times it is referred to.
+type modeler struct {
+	c       *compiler
+	rules   map[*Node]*Rule
+	regdefs map[*Node]*Regdef
+}
+
+// buildModel returns the model of top. The first and follow sets of top
+// must be built.
+func (c *compiler) buildModel(top *Node) *Grammar {
+	m := &modeler{
+		c:       c,
+		rules:   make(map[*Node]*Rule),
+		regdefs: make(map[*Node]*Regdef),
+	}
+	g := &Grammar{
+		Name: top.sym.name,
+		Pos:  tokenPos(top.pos),
+	}
+	for _, dcl := range top.nodes {
+		switch {
+		case dcl.op == ORULE && actionOf(dcl) == nil:
+			r := m.rule(dcl)
+			if dcl == top.left {
+				g.Start = r
+			}
+			g.Rules = append(g.Rules, r)
+		case dcl.op == OREGDEF:
+			g.Regdefs = append(g.Regdefs, m.regdef(dcl))
+		case dcl.op == OKEYWORD:
+			for _, e := range dcl.nodes {
+				g.Keywords = append(g.Keywords, tokString(e))
+			}
+		case dcl.op == OSYNC:
+			for _, e := range dcl.nodes {
+				g.Sync = append(g.Sync, tokString(e))
+			}
+		}
+	}
+	return g
+}
+
+func (m *modeler) rule(dcl *Node) *Rule {
+	if r, ok := m.rules[dcl]; ok {
+		return r
+	}
+	r := &Rule{
+		Name:     dcl.sym.name,
+		Type:     typeName(dcl),
+		Pos:      tokenPos(dcl.pos),
+		Nullable: m.c.first[dcl][nepsilon],
+		First:    tokNames(m.c.first[dcl]),
+		Follow:   tokNames(m.c.follow[dcl]),
+	}
+	if root := dcl.root(); root != dcl {
+		r.Origin = root.sym.name
+	}
+	m.rules[dcl] = r
+	for _, prod := range dcl.nodes {
+		p := &Production{Pos: tokenPos(prod.pos)}
+		for _, elem := range prod.nodes {
+			p.Elements = append(p.Elements, m.element(elem))
+		}
+		r.Productions = append(r.Productions, p)
+	}
+	return r
+}
+
+func (m *modeler) element(elem *Node) *Element {
+	e := new(Element)
+	if elem.sym != nil {
+		e.Var = elem.sym.name
+	}
+	switch n := elem.left; {
+	case actionOf(n) != nil:
+		a := actionOf(n)
+		e.Kind = ElemAction
+		e.Action = &Action{
+			Code: string(a.code),
+			Pos:  tokenPos(a.pos),
+		}
+		for _, d := range a.dpn {
+			e.Action.Uses = append(e.Action.Uses, d.sym.name)
+		}
+	case n.op == ORULE:
+		e.Kind = ElemRule
+		e.Rule = m.rule(n)
+	case n.op == OREGDEF:
+		e.Kind = ElemRegdef
+		e.Regdef = m.regdef(n)
+	case n.op == OSTRLIT:
+		e.Kind = ElemLiteral
+		e.Literal = n.lit.lit
+	default:
+		e.Kind = ElemEmpty
+	}
+	return e
+}
+
+func (m *modeler) regdef(dcl *Node) *Regdef {
+	if d, ok := m.regdefs[dcl]; ok {
+		return d
+	}
+	d := &Regdef{
+		Name: dcl.sym.name,
+		Type: typeName(dcl),
+		Pos:  tokenPos(dcl.pos),
+		Mode: dcl.mode,
+	}
+	for _, cmd := range dcl.cmds {
+		d.Commands = append(d.Commands, cmd.String())
+	}
+	m.regdefs[dcl] = d
+	d.Regex = m.regex(dcl.left)
+	return d
+}
+
+func (m *modeler) regex(n *Node) *RegexNode {
+	switch n.op {
+	case OALT, OCAT:
+		// Chains of the same operator are one node
+		x := &RegexNode{Op: RegexAlt}
+		if n.op == OCAT {
+			x.Op = RegexCat
+		}
+		var flatten func(n1 *Node)
+		flatten = func(n1 *Node) {
+			if n1.op == n.op {
+				flatten(n1.left)
+				flatten(n1.right)
+				return
+			}
+			x.Children = append(x.Children, m.regex(n1))
+		}
+		flatten(n)
+		return x
+	case OKLEENE:
+		return &RegexNode{Op: RegexStar, Children: []*RegexNode{m.regex(n.left)}}
+	case OPLUS:
+		return &RegexNode{Op: RegexPlus, Children: []*RegexNode{m.regex(n.left)}}
+	case OREPEAT:
+		return &RegexNode{
+			Op:       RegexRepeat,
+			Children: []*RegexNode{m.regex(n.left)},
+			Min:      n.lb,
+			Max:      n.ub,
+		}
+	case OCLASS:
+		x := &RegexNode{Op: RegexClass, Negated: n.neg}
+		for _, n1 := range n.nodes {
+			x.Children = append(x.Children, m.regex(n1))
+		}
+		return x
+	case ORANGE:
+		return &RegexNode{Op: RegexRange, Lo: n.left.char, Hi: n.right.char}
+	case OCHAR:
+		return &RegexNode{Op: RegexChar, Lo: n.char, Hi: n.char}
+	case OCATEGORY:
+		return &RegexNode{Op: RegexCategory, Negated: n.neg, Name: n.cat}
+	case OSTRLIT:
+		return &RegexNode{Op: RegexLiteral, Literal: n.lit.lit}
+	case OREGDEF:
+		return &RegexNode{Op: RegexRegdef, Regdef: m.regdef(n)}
+	}
+	panic(fmt.Sprintf("unexpected op %s in a regular expression", n.op))
+}
+
+// tokNames returns the names of the tokens of set, without the empty
+// string, in order.
+func tokNames(set map[*Node]bool) []string {
+	var l []string
+	for k := range set {
+		if k != nepsilon {
+			l = append(l, tokString(k))
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+func typeName(n *Node) string {
+	if n.ntype == nil {
+		return ""
+	}
+	return n.ntype.typ
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"go/ast"
+	"strings"
+	"unicode"
 )
 
 const (
@@ -19,6 +21,8 @@ const (
 	OSELF
 
 	OSTRLIT
+	OKEYWORD
+	OSYNC
 	OTYPE
 	OACTION
 	OEPSILON
@@ -32,6 +36,7 @@ const (
 	OCLASS
 	ORANGE
 	OCHAR
+	OCATEGORY
 )
 
 type NodeOp int
@@ -44,6 +49,8 @@ var nodeOpLabels = map[NodeOp]string{
 	OPROD:    "oprod",
 	OREGDEF:  "oregdef",
 	OSTRLIT:  "ostrlit",
+	OKEYWORD: "okeyword",
+	OSYNC:    "osync",
 	OTYPE:    "otype",
 	OACTION:  "oaction",
 	OEPSILON: "oepsilon",
@@ -67,7 +74,7 @@ type Node struct {
 	op      NodeOp
 	sym     *Sym
 	lit     *Strlit
-	byt     byte
+	char    rune
 	pos     *Position
 	isError bool
 	dpn     []*Node // OPRODDCL that this node depends upon
@@ -80,6 +87,10 @@ type Node struct {
 	// OPRODDCL
 	used bool
 
+	// ORULE created by removing left recursion: the OPRODDCL that stood
+	// for the recursive element, whose value is the result parsed so far
+	acc *Node
+
 	// OACTION/OTYPE
 	code  []byte
 	typ   string
@@ -89,8 +100,58 @@ type Node struct {
 	lb int
 	ub int
 
-	// OCLASS
+	// OCLASS and OCATEGORY
 	neg bool
+
+	// OCATEGORY, a Unicode category or script in a class
+	cat string
+
+	// OREGDEF: the lexer mode it is a token of, empty for the default
+	// mode, and the commands run when it matches
+	mode string
+	cmds []lexCmd
+}
+
+// defaultMode is the name of the lexer mode of the regdefs declared
+// outside of any lexer mode block, and of the string literals.
+const defaultMode = "DEFAULT"
+
+// lexCmd is a command run by the lexer when a regdef matches: push
+// switches to mode, keeping the current one on a stack, pop switches back
+// to the mode on top of the stack, and switch replaces the current mode.
+// skip drops the token, and hidden keeps it for the next token the parser
+// gets.
+type lexCmd struct {
+	op   string
+	mode string
+	pos  *Position
+}
+
+func (cmd lexCmd) String() string {
+	if cmd.mode == "" {
+		return cmd.op
+	}
+	return fmt.Sprintf("%s(%s)", cmd.op, cmd.mode)
+}
+
+// cmdsString returns the commands of the regdef n as written after ->.
+func cmdsString(n *Node) string {
+	l := make([]string, len(n.cmds))
+	for i, cmd := range n.cmds {
+		l[i] = cmd.String()
+	}
+	return strings.Join(l, ", ")
+}
+
+// hiddenBy returns skip or hidden when the regdef n is one of the tokens
+// the parser never gets, and the empty string otherwise.
+func hiddenBy(n *Node) string {
+	for _, cmd := range n.cmds {
+		if cmd.op == "skip" || cmd.op == "hidden" {
+			return cmd.op
+		}
+	}
+	return ""
 }
 
 var nepsilon = &Node{
@@ -116,7 +177,28 @@ func (n *Node) dcopy(c *Node) *Node {
 	return n
 }
 
-func nodeRuleFromFactoring(dcl *Node, remain [][]*Node) (rule *Node) {
+// actionOf returns the OACTION of a rule built by parseAction, or nil if
+// n is any other node.
+func actionOf(n *Node) *Node {
+	if n.op != ORULE || len(n.nodes) != 1 || len(n.nodes[0].nodes) != 1 {
+		return nil
+	}
+	a := n.nodes[0].nodes[0].right
+	if a == nil || a.op != OACTION {
+		return nil
+	}
+	return a
+}
+
+// root returns the rule written by the user that n was derived from.
+func (n *Node) root() *Node {
+	for n.orig != nil {
+		n = n.orig
+	}
+	return n
+}
+
+func (c *compiler) nodeRuleFromFactoring(dcl *Node, remain [][]*Node) (rule *Node) {
 	prods := make([]*Node, 0)
 	for _, elmns := range remain {
 		if len(elmns) == 0 {
@@ -132,39 +214,42 @@ func nodeRuleFromFactoring(dcl *Node, remain [][]*Node) (rule *Node) {
 		})
 	}
 
-	rname := primeName(dcl.sym.name)
-	s := symbols.lookup(rname)
+	s := c.primeName(dcl.sym)
 	rule = &Node{
 		op:    ORULE,
 		sym:   s,
 		nodes: prods,
+		ntype: dcl.ntype,
 		orig:  dcl,
 	}
-	declare(rule)
+	c.declare(rule)
 	return
 }
 
 // NOTE: Example for the uglyness of OOP
-func nodeRuleFromLeftRecursion(dcl *Node, prod *Node) (rule *Node) {
-	rname := primeName(dcl.sym.name)
-	s := symbols.lookup(rname)
+func (c *compiler) nodeRuleFromLeftRecursion(dcl *Node, prod *Node) (rule *Node) {
+	s := c.primeName(dcl.sym)
 	rule = &Node{
-		op:   ORULE,
-		sym:  s,
-		orig: dcl,
+		op:    ORULE,
+		sym:   s,
+		ntype: dcl.ntype,
+		orig:  dcl,
+		acc:   prod.nodes[0],
 	}
-	declare(rule)
+	c.declare(rule)
 	remain := prod.nodes[1:]
 
 	prods := make([]*Node, 0)
 	prods = append(prods, &Node{
 		op:    OPROD,
 		nodes: []*Node{nepsilon.prodDcl()},
+		pos:   prod.pos,
 	})
 
 	prods = append(prods, &Node{
 		op:    OPROD,
 		nodes: append(remain, rule.prodDcl()),
+		pos:   prod.pos,
 	})
 	rule.nodes = prods 
 	
@@ -184,6 +269,35 @@ func escapeStrlit(s string) string {
 	return b.String()
 }
 
+// escapeClassChar returns c as written in a character class.
+func escapeClassChar(c rune) string {
+	switch c {
+	case '\n':
+		return `\n`
+	case '\t':
+		return `\t`
+	case '\r':
+		return `\r`
+	case '\\', '[', ']', '-', '^', ' ':
+		return `\` + string(c)
+	}
+	if !unicode.IsPrint(c) {
+		if c > 0xffff {
+			return fmt.Sprintf(`\U%08x`, c)
+		}
+		return fmt.Sprintf(`\u%04x`, c)
+	}
+	return string(c)
+}
+
+// categoryString returns the OCATEGORY n as written in a class.
+func categoryString(n *Node) string {
+	if n.neg {
+		return fmt.Sprintf(`\P{%s}`, n.cat)
+	}
+	return fmt.Sprintf(`\p{%s}`, n.cat)
+}
+
 func (n *Node) dumpTree() {
 	w := consStdoutCodeWriter()
 	walkdump(n, w)
@@ -229,6 +343,12 @@ func walkdump(n *Node, w *CodeWriter) {
 		if n.ntype != nil {
 			w.write(" -- TYPE: %s", n.ntype.typ)
 		}
+		if n.mode != "" {
+			w.write(" -- MODE: %s", n.mode)
+		}
+		if len(n.cmds) > 0 {
+			w.write(" -- CMDS: %s", cmdsString(n))
+		}
 		w.newline()
 		w.enter()
 		walkdump(n.left, w)
@@ -277,9 +397,31 @@ func walkdump(n *Node, w *CodeWriter) {
 		walkdump(n.right, w)
 		w.exit()
 	case OCHAR:
-		w.writeln("(OCHAR '%c')", n.byt)
+		w.writeln("(OCHAR '%s')", escapeClassChar(n.char))
+	case OCATEGORY:
+		w.writeln("(OCATEGORY %s)", categoryString(n))
 	case OSTRLIT:
 		w.writeln("(OSTRLIT '%s')", escapeStrlit(n.lit.lit))
+	case OKEYWORD:
+		w.writeln("(KEYWORD")
+		w.enter()
+		for _, n2 := range n.nodes {
+			walkdump(n2, w)
+		}
+		w.writeln(")")
+		w.exit()
+	case OSYNC:
+		w.writeln("(SYNC")
+		w.enter()
+		for _, n2 := range n.nodes {
+			if n2.op == OREGDEF {
+				w.writeln("(REGDEF: %s)", n2.sym)
+				continue
+			}
+			walkdump(n2, w)
+		}
+		w.writeln(")")
+		w.exit()
 	case ORULE:
 		w.write("(RULE: %s", n.sym)
 		if n.ntype != nil {
@@ -1,21 +1,29 @@
 package zebu
 
+//
 import (
 	"fmt"
 	"go/ast"
 	"go/parser"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
 )
 
 // Debug, erase when done
 var _ = fmt.Printf
 
 type Parser struct {
+	c     *compiler
 	lexer *Lexer
 	lh    *Token
 }
 
-func consParser() (p *Parser) {
+func consParser(c *compiler) (p *Parser) {
 	p = &Parser{
+		c:     c,
 		lexer: nil,
 		lh:    nil,
 	}
@@ -38,7 +46,7 @@ func (p *Parser) check(k TokenKind) bool {
 func (p *Parser) match(k TokenKind) (t *Token, err error) {
 	if t = p.next(); t.kind != k {
 		t = nil
-		err = compileError(p.lh.pos, "expected %s", k)
+		err = p.c.compileError(p.lh.pos, "expected %s", k)
 	}
 	return
 }
@@ -69,14 +77,17 @@ func (p *Parser) parseChar() (n *Node, err error) {
 			return
 		}
 		if s.defn == nil {
-			err = compileError(p.lh.pos, "undeclared regular definition!")
+			if n = p.c.lookupImport(s); n != nil {
+				return
+			}
+			err = p.c.compileError(p.lh.pos, "undeclared regular definition!")
 			return
 		}
 		n = s.defn
 	case STRLIT:
 		n, err = p.parseStrlit()
 	default:
-		err = compileError(p.lh.pos, "expected regular definition or string literal, found %s", p.lh)
+		err = p.c.compileError(p.lh.pos, "expected regular definition or string literal, found %s", p.lh)
 		return
 	}
 	return
@@ -108,13 +119,35 @@ func (p *Parser) parseClassBodyChar() (n *Node, err error) {
 		return
 	}
 	n = &Node{
-		op:  OCHAR,
-		byt: t.byt,
+		op:   OCHAR,
+		char: t.char,
+	}
+	return
+}
+
+// parseClassBodyCategory parses a Unicode category or script, as in
+// \p{L}, which stands for all of its characters.
+func (p *Parser) parseClassBodyCategory() (n *Node, err error) {
+	var t *Token
+	if t, err = p.match(REGCAT); err != nil {
+		return
+	}
+	n = &Node{
+		op:  OCATEGORY,
+		pos: t.pos,
+		neg: t.nval == 1,
+		cat: string(t.code),
+	}
+	if unicodeTable(n.cat) == nil {
+		p.c.compileError(t.pos, "unknown Unicode category or script %s.", n.cat)
 	}
 	return
 }
 
 func (p *Parser) parseClassBodyRange() (n *Node, err error) {
+	if p.lh.kind == REGCAT {
+		return p.parseClassBodyCategory()
+	}
 	var n1 *Node
 	if n1, err = p.parseClassBodyChar(); err != nil {
 		return
@@ -205,6 +238,7 @@ func (p *Parser) parseRepeat() (n *Node, err error) {
 		return
 	}
 	if p.lh.kind == '{' {
+		pos := p.lh.pos
 		var lb, ub int
 		if lb, ub, err = p.parseRepeatBody(); err != nil {
 			return
@@ -212,6 +246,7 @@ func (p *Parser) parseRepeat() (n *Node, err error) {
 		n = &Node{
 			op:   OREPEAT,
 			left: n,
+			pos:  pos,
 			lb:   lb,
 			ub:   ub,
 		}
@@ -307,8 +342,13 @@ func (p *Parser) parseRegdef() (n *Node, err error) {
 		return
 	}
 	n.op = OREGDEF
-	declare(n)
+	p.c.declare(n)
+	err = p.parseRegdefDefn(n)
+	return
+}
 
+// parseRegdefDefn parses the optional type and the body of the regdef n.
+func (p *Parser) parseRegdefDefn(n *Node) (err error) {
 	if p.lh.kind == '=' {
 		// TODO : Somewhat hacky to lex/parse right now, clean up
 		// later
@@ -316,7 +356,7 @@ func (p *Parser) parseRegdef() (n *Node, err error) {
 		p.check('=')
 		p.lexer.raw()
 		if n.ntype, err = p.parseType(); err != nil {
-			err = reerror(lpos, err.(*CCError))
+			err = p.c.reerror(lpos, err.(*CCError))
 			return
 		}
 	}
@@ -329,21 +369,129 @@ func (p *Parser) parseRegdef() (n *Node, err error) {
 	if err != nil {
 		return
 	}
+	if p.lh.kind == '-' {
+		n.cmds, err = p.parseLexCmds()
+	}
+	return
+}
+
+// parseLexCmds parses the commands after the regex of a regdef, as in
+// -> push(STRING) or -> skip, which the lexer runs when the regdef
+// matches.
+func (p *Parser) parseLexCmds() (l []lexCmd, err error) {
+	p.match('-')
+	if _, err = p.match('>'); err != nil {
+		return
+	}
+	for {
+		t := p.lh
+		if t.kind != TERMINAL {
+			err = p.c.compileError(t.pos, "expected lexer command, found %s", t)
+			return
+		}
+		p.next()
+		cmd := lexCmd{op: t.sym.name, pos: t.pos}
+		switch cmd.op {
+		case "push", "switch":
+			if _, err = p.match('('); err != nil {
+				return
+			}
+			if cmd.mode, err = p.parseModeName(); err != nil {
+				return
+			}
+			if _, err = p.match(')'); err != nil {
+				return
+			}
+		case "pop":
+		case "skip", "hidden":
+			for _, cmd1 := range l {
+				if cmd1.op == "skip" || cmd1.op == "hidden" {
+					err = p.c.compileError(t.pos, "lexer commands %s and %s cannot be used together.", cmd1.op, cmd.op)
+					return
+				}
+			}
+		default:
+			err = p.c.compileError(t.pos, "unknown lexer command %s.", cmd.op)
+			return
+		}
+		l = append(l, cmd)
+		if p.lh.kind != ',' {
+			break
+		}
+		p.match(',')
+	}
+	return
+}
+
+// parseModeName parses the name of a lexer mode, any identifier.
+func (p *Parser) parseModeName() (name string, err error) {
+	if p.lh.kind != TERMINAL && p.lh.kind != NONTERMINAL {
+		err = p.c.compileError(p.lh.pos, "expected lexer mode name, found %s", p.lh)
+		return
+	}
+	name = p.lh.sym.name
+	p.next()
+	return
+}
+
+// parseLexerMode parses a lexer mode block, the regdefs of a lexer mode.
+// They are declarations of the grammar top like any other regdef.
+func (p *Parser) parseLexerMode(top *Node) (err error) {
+	if _, err = p.match(LEXER); err != nil {
+		return
+	}
+	if p.lh.kind != TERMINAL || p.lh.sym.name != "mode" {
+		err = p.c.compileError(p.lh.pos, "expected mode after lexer, found %s", p.lh)
+		return
+	}
+	p.next()
+	var mode string
+	if mode, err = p.parseModeName(); err != nil {
+		return
+	}
+	if _, err = p.match('{'); err != nil {
+		return
+	}
+	for p.lh.kind != '}' && p.lh.kind != EOF {
+		if p.lh.kind != NONTERMINAL {
+			p.c.compileError(p.lh.pos, "expected regular definition in lexer mode %s, found %s", mode, p.lh)
+			for p.lh.kind != ';' && p.lh.kind != '}' && p.lh.kind != EOF {
+				p.next()
+			}
+			if p.lh.kind == ';' {
+				p.next()
+			}
+			continue
+		}
+		var n *Node
+		if n, err = p.parseDecl(); err != nil || n == nil {
+			continue
+		}
+		if mode != defaultMode {
+			n.mode = mode
+		}
+		top.nodes = append(top.nodes, n)
+	}
+	_, err = p.match('}')
 	return
 }
 
 func (p *Parser) parseAction() (n *Node, err error) {
-	_, err = p.match('{')
-	if err != nil {
+	pos := p.lh.pos
+	if !p.check('{') {
+		err = p.c.compileError(pos, "expected {")
 		return
 	}
+	// The action is read raw, starting right after the '{'
+	p.lexer.raw()
 	lvl := 0
 	codebuf := make([]byte, 0, 512)
 	dpn := make([]*Node, 0)
+	c := p.lexer.raw()
 	for {
-		c := p.lexer.raw()
 		if c == 0 {
-			exit(1)
+			err = p.c.compileError(pos, "unterminated action, missing }.")
+			return
 		}
 		if c == '}' && lvl == 0 {
 			break
@@ -355,16 +503,17 @@ func (p *Parser) parseAction() (n *Node, err error) {
 			lvl--
 		case '$':
 			buf := []byte{'$'}
-			c1 := p.lexer.raw()
-			for isVarIdChar(c1) {
-				buf = append(buf, c1)
-				c1 = p.lexer.raw()
+			c = p.lexer.raw()
+			for isVarIdChar(c) {
+				buf = append(buf, byte(c))
+				c = p.lexer.raw()
 			}
-			p.lexer.putc(c1)
-			s := symbols.lookup(string(buf))
+			s := p.c.symbols.lookup(string(buf))
 			if s.defn == nil {
 				if s.name != "$$" {
-					compileError(zbpos, "undefined variable id %s", s)
+					p.c.compileError(p.c.zbpos, "undefined variable id %s", s)
+				} else if p.c.currule.ntype == nil {
+					p.c.compileError(p.c.zbpos, "$$ used in %s, which has no type", p.c.currule.sym)
 				}
 			} else {
 				s.defn.used = true
@@ -373,9 +522,11 @@ func (p *Parser) parseAction() (n *Node, err error) {
 			codebuf = append(codebuf, buf...)
 			continue
 		}
-		codebuf = append(codebuf, c)
+		codebuf = utf8.AppendRune(codebuf, c)
+		c = p.lexer.raw()
 	}
-	// Reset the lh token
+	// Reset the lh token, starting from the character after the '}'
+	p.lexer.unraw()
 	p.next()
 
 	// TODO: Lots of tricky logic here. Eventually move.
@@ -384,17 +535,26 @@ func (p *Parser) parseAction() (n *Node, err error) {
 	// (3) Create a new epsilon production for this rule that takes the actual action.
 	// (4) Return a reference to the ORULE so it gets placed in an OPRODDCL
 	// (5) Insert the new ORULE into the grammar
-	s := symbols.lookup(fmt.Sprintf("'A%d_%s", nextaction, currule.sym))
-	nextaction++
+	// A rule redefined by override or modify already has actions, skip
+	// the names they use
+	s := p.c.symbols.lookupGrammar(fmt.Sprintf("'A%d_%s", p.c.nextaction, p.c.currule.sym), p.lexer.gram)
+	for s.defn != nil {
+		p.c.nextaction++
+		s = p.c.symbols.lookupGrammar(fmt.Sprintf("'A%d_%s", p.c.nextaction, p.c.currule.sym), p.lexer.gram)
+	}
+	p.c.nextaction++
 
 	action := &Node{
 		op:   OACTION,
 		code: codebuf,
-		sym: s,
-	} 
+		sym:  s,
+		pos:  pos,
+		dpn:  dpn,
+	}
 
 	n = newname(s)
 	n.op = ORULE
+	n.pos = pos
 	n.nodes = []*Node{&Node{
 		op: OPROD,
 		nodes: []*Node{&Node{
@@ -403,8 +563,8 @@ func (p *Parser) parseAction() (n *Node, err error) {
 			right: action,
 		}},
 	}}
-	declare(n)
-	curgram.nodes = append(curgram.nodes, n)
+	p.c.declare(n)
+	p.c.curgram.nodes = append(p.c.curgram.nodes, n)
 
 	return
 }
@@ -437,7 +597,7 @@ func (p *Parser) parseNonterm() (n *Node, err error) {
 	if err != nil {
 		return
 	}
-	n = oldname(s)
+	n = p.c.oldname(s)
 	return
 }
 
@@ -446,7 +606,7 @@ func (p *Parser) parseTerm() (n *Node, err error) {
 	if err != nil {
 		return
 	}
-	n = oldname(s)
+	n = p.c.oldname(s)
 	return
 }
 
@@ -465,7 +625,7 @@ func (p *Parser) parseProdElem() (n *Node, err error) {
 	case '{':
 		n2, err = p.parseAction()
 	default:
-		err = compileError(p.lh.pos, "unexpected %s.", p.lh)
+		err = p.c.compileError(p.lh.pos, "unexpected %s.", p.lh)
 	}
 	if err != nil {
 		return
@@ -476,24 +636,26 @@ func (p *Parser) parseProdElem() (n *Node, err error) {
 	}
 	if p.lh.kind == '=' {
 		p.match('=')
+		n.pos = p.lh.pos
 		n.sym, err = p.parseVarId()
 		if err != nil {
 			return
 		}
-		declare(n)
-		pushvarid(n.sym)
+		p.c.declare(n)
+		p.c.pushvarid(n.sym)
 	} else {
-		n.sym = pushnextvarid()
-		declare(n)
+		n.sym = p.c.pushnextvarid()
+		p.c.declare(n)
 	}
 
 	return
 }
 
 func (p *Parser) parseProd() (n *Node, err error) {
+	pos := p.lh.pos
 	l := make([]*Node, 0)
-	nextvarid = 1
-	defer popvarids()
+	p.c.nextvarid = 1
+	defer p.c.popvarids()
 	for {
 		var n2 *Node
 		if n2, err = p.parseProdElem(); err != nil {
@@ -503,24 +665,32 @@ func (p *Parser) parseProd() (n *Node, err error) {
 		if p.lh.kind == '|' || p.lh.kind == ';' {
 			break
 		}
-		nextvarid++
+		p.c.nextvarid++
 	}
 	n = &Node{
 		op:    OPROD,
 		nodes: l,
+		pos:   pos,
 	}
 	return
 }
 
-func (p *Parser) parseRuleBody() (l []*Node, err error) {
+// parseRuleBody parses the productions of a rule, the first of them
+// following the ':' at pos. An empty production is placed at the ':' or
+// '|' before it.
+func (p *Parser) parseRuleBody(pos *Position) (l []*Node, err error) {
 	l = make([]*Node, 0)
 	for {
 		var n *Node
 		if n, err = p.parseProd(); err != nil {
 			return
 		}
+		if len(n.nodes) == 1 && n.nodes[0].left.op == OEPSILON {
+			n.pos = pos
+		}
 		l = append(l, n)
 		if p.lh.kind == '|' {
+			pos = p.lh.pos
 			p.match('|')
 			continue
 		}
@@ -534,13 +704,17 @@ func (p *Parser) parseRuleBody() (l []*Node, err error) {
 // actual type checking, possibly using some of the APIs go provides.
 func (p *Parser) parseType() (n *Node, err error) {
 	typ := make([]byte, 0, 10)
-	var c, c1 byte
+	var c, c1 rune
 	for {
 	whitespace:
 		c = p.lexer.raw()
 		if c == ':' {
 			break
 		}
+		if c == 0 {
+			err = consCCError(nil, "unterminated type declaration, missing :.")
+			return
+		}
 		if isWhitespace(c) {
 			goto whitespace
 		}
@@ -548,18 +722,20 @@ func (p *Parser) parseType() (n *Node, err error) {
 			c1 = p.lexer.raw()
 			switch c1 {
 			case '/':
-				for c1 != '\n' {
+				for c1 != '\n' && c1 != 0 {
 					c1 = p.lexer.raw()
 				}
 				goto whitespace
 			case '*':
-				c1 = p.lexer.raw()
 				for {
-					if c1 == '*' {
-						c1 = p.lexer.raw()
-						if c1 == '/' {
-							break
-						}
+					c1 = p.lexer.raw()
+					if c1 == 0 {
+						err = consCCError(nil, "unterminated comment.")
+						return
+					}
+					if c1 == '*' && p.lexer.ch == '/' {
+						p.lexer.raw()
+						break
 					}
 				}
 				goto whitespace
@@ -567,7 +743,7 @@ func (p *Parser) parseType() (n *Node, err error) {
 				p.lexer.putc(c1)
 			}
 		}
-		typ = append(typ, c)
+		typ = utf8.AppendRune(typ, c)
 	}
 
 	if len(typ) == 0 {
@@ -580,7 +756,7 @@ func (p *Parser) parseType() (n *Node, err error) {
 
 	// Check type table to intern the ast.Expr
 	typestr := string(typ[:])
-	if etype, ok := types.lookup(typestr); ok {
+	if etype, ok := p.c.types.lookup(typestr); ok {
 		n = &Node{
 			op:    OTYPE,
 			typ:   typestr,
@@ -596,7 +772,7 @@ func (p *Parser) parseType() (n *Node, err error) {
 	}
 
 	switch etype.(type) {
-	case *ast.ArrayType, *ast.ChanType, *ast.FuncType, *ast.Ident, *ast.InterfaceType, *ast.MapType, *ast.SelectorExpr, *ast.StructType:
+	case *ast.ArrayType, *ast.ChanType, *ast.FuncType, *ast.Ident, *ast.InterfaceType, *ast.MapType, *ast.SelectorExpr, *ast.StarExpr, *ast.StructType:
 		// TODO : Place holder
 		break
 	default:
@@ -604,7 +780,7 @@ func (p *Parser) parseType() (n *Node, err error) {
 		return
 	}
 
-	types.insert(typestr, etype)
+	p.c.types.insert(typestr, etype)
 
 	n = &Node{
 		op:    OTYPE,
@@ -630,9 +806,15 @@ func (p *Parser) parseRule() (n *Node, err error) {
 		return
 	}
 	n.op = ORULE
-	declare(n)
-	currule = n
-	nextaction = 0
+	p.c.declare(n)
+	err = p.parseRuleDefn(n)
+	return
+}
+
+// parseRuleDefn parses the optional type and the productions of the rule n.
+func (p *Parser) parseRuleDefn(n *Node) (err error) {
+	p.c.currule = n
+	p.c.nextaction = 0
 
 	if p.lh.kind == '=' {
 		// TODO : Somewhat hacky to lex/parse right now, clean up
@@ -641,15 +823,16 @@ func (p *Parser) parseRule() (n *Node, err error) {
 		p.check('=')
 		p.lexer.raw()
 		if n.ntype, err = p.parseType(); err != nil {
-			err = reerror(lpos, err.(*CCError))
+			err = p.c.reerror(lpos, err.(*CCError))
 			return
 		}
 	}
+	cpos := p.lh.pos
 	if _, err = p.match(':'); err != nil {
 		return
 	}
 
-	n.nodes, err = p.parseRuleBody()
+	n.nodes, err = p.parseRuleBody(cpos)
 	if err != nil {
 		return
 	}
@@ -662,15 +845,28 @@ func (p *Parser) parseDecl() (n *Node, err error) {
 		n, err = p.parseRule()
 	case NONTERMINAL:
 		n, err = p.parseRegdef()
+	case KEYWORD:
+		n, err = p.parseKeyword()
+	case SYNC:
+		n, err = p.parseSync()
+	case OVERRIDE:
+		err = p.parseOverride()
+	case DELETE:
+		err = p.parseDelete()
+	case MODIFY:
+		err = p.parseModify()
 	default:
-		err = compileError(p.lh.pos, "expected terminal or nonterminal declaration, found %s", p.lh)
+		err = p.c.compileError(p.lh.pos, "expected terminal or nonterminal declaration, found %s", p.lh)
 	}
 
 	// error recovery, simply skip to the next semicolon (the end of a declaration)
 	if err != nil {
-		for p.lh.kind != ';' {
+		for p.lh.kind != ';' && p.lh.kind != EOF {
 			p.next()
 		}
+		if p.lh.kind == EOF {
+			return
+		}
 	}
 
 	p.match(';')
@@ -678,13 +874,278 @@ func (p *Parser) parseDecl() (n *Node, err error) {
 	return
 }
 
+// parseKeyword parses a list of reserved words. A keyword is written in
+// rules like any string literal, but is lexed by checking the matches of
+// an identifier-like regdef against a table of keywords.
+func (p *Parser) parseKeyword() (n *Node, err error) {
+	pos := p.lh.pos
+	if _, err = p.match(KEYWORD); err != nil {
+		return
+	}
+	n = &Node{
+		op:  OKEYWORD,
+		pos: pos,
+	}
+	for {
+		var n1 *Node
+		if n1, err = p.parseStrlit(); err != nil {
+			return
+		}
+		n.nodes = append(n.nodes, n1)
+		if p.lh.kind != ',' {
+			break
+		}
+		p.match(',')
+	}
+	return
+}
+
+// parseSync parses a list of sync tokens, string literals or regdefs. A
+// generated parser recovering from a syntax error skips the input past
+// one of them, or up to a token that can follow the rule it was parsing.
+func (p *Parser) parseSync() (n *Node, err error) {
+	pos := p.lh.pos
+	if _, err = p.match(SYNC); err != nil {
+		return
+	}
+	n = &Node{
+		op:  OSYNC,
+		pos: pos,
+	}
+	for {
+		var n1 *Node
+		if p.lh.kind == NONTERMINAL {
+			n1, err = p.parseNonterm()
+		} else {
+			n1, err = p.parseStrlit()
+		}
+		if err != nil {
+			return
+		}
+		n.nodes = append(n.nodes, n1)
+		if p.lh.kind != ',' {
+			break
+		}
+		p.match(',')
+	}
+	return
+}
+
+// inherited returns the definition of s that a redefinition edits, or
+// the error it reports when there is none. Only rules and regdefs
+// declared earlier, usually by the base grammar, can be redefined.
+func (c *compiler) inherited(s *Sym, op NodeOp, verb string) (n *Node, err error) {
+	n = s.defn
+	if n == nil || n.op != op {
+		what := "rule"
+		if op == OREGDEF {
+			what = "regular definition"
+		}
+		return nil, c.compileError(s.pos, "cannot %s %s, no %s of that name is defined.", verb, s, what)
+	}
+	return n, nil
+}
+
+// removeDecl takes n out of the grammar being parsed.
+func (c *compiler) removeDecl(n *Node) {
+	l := c.curgram.nodes[:0]
+	for _, n1 := range c.curgram.nodes {
+		if n1 != n {
+			l = append(l, n1)
+		}
+	}
+	c.curgram.nodes = l
+	if c.curgram.left == n {
+		c.curgram.left = nil
+	}
+}
+
+// dropActions removes the action rules used by prods, which are about to
+// be replaced or removed.
+func (c *compiler) dropActions(prods []*Node) {
+	for _, prod := range prods {
+		for _, elem := range prod.nodes {
+			if actionOf(elem.left) != nil {
+				c.removeDecl(elem.left)
+			}
+		}
+	}
+}
+
+// parseOverride replaces the definition of a rule or regdef. The existing
+// node is updated in place so every reference to it, including those in
+// the base grammar, sees the new definition.
+func (p *Parser) parseOverride() (err error) {
+	if _, err = p.match(OVERRIDE); err != nil {
+		return
+	}
+	switch p.lh.kind {
+	case TERMINAL:
+		var n *Node
+		if n, err = p.parseRuleHead(); err != nil {
+			return
+		}
+		n.op = ORULE
+		old, _ := p.c.inherited(n.sym, ORULE, "override")
+		if err = p.parseRuleDefn(n); err != nil || old == nil {
+			return
+		}
+		p.c.dropActions(old.nodes)
+		old.nodes, old.ntype, old.pos = n.nodes, n.ntype, n.pos
+	case NONTERMINAL:
+		var n *Node
+		if n, err = p.parseRegdefHead(); err != nil {
+			return
+		}
+		n.op = OREGDEF
+		old, _ := p.c.inherited(n.sym, OREGDEF, "override")
+		if err = p.parseRegdefDefn(n); err != nil || old == nil {
+			return
+		}
+		old.left, old.ntype, old.pos, old.cmds = n.left, n.ntype, n.pos, n.cmds
+	default:
+		err = p.c.compileError(p.lh.pos, "expected rule or regular definition after override, found %s", p.lh)
+	}
+	return
+}
+
+// parseDelete removes a rule or regdef. Any remaining use of it is
+// reported as unresolved.
+func (p *Parser) parseDelete() (err error) {
+	if _, err = p.match(DELETE); err != nil {
+		return
+	}
+	var s *Sym
+	var n *Node
+	switch p.lh.kind {
+	case TERMINAL:
+		if s, err = p.parseTermName(); err != nil {
+			return
+		}
+		if n, _ = p.c.inherited(s, ORULE, "delete"); n != nil {
+			p.c.dropActions(n.nodes)
+		}
+	case NONTERMINAL:
+		if s, err = p.parseNontermName(); err != nil {
+			return
+		}
+		n, _ = p.c.inherited(s, OREGDEF, "delete")
+	default:
+		err = p.c.compileError(p.lh.pos, "expected rule or regular definition after delete, found %s", p.lh)
+		return
+	}
+	if n == nil {
+		return
+	}
+	p.c.removeDecl(n)
+	n.op = ONONAME
+	s.defn = nil
+	s.dead = true
+	return
+}
+
+// parseModify adds productions to, or removes productions from, a rule.
+// Each production is marked with + to add it or - to remove the
+// production with the same elements.
+func (p *Parser) parseModify() (err error) {
+	if _, err = p.match(MODIFY); err != nil {
+		return
+	}
+	var s *Sym
+	if s, err = p.parseTermName(); err != nil {
+		return
+	}
+	var n *Node
+	if n, err = p.c.inherited(s, ORULE, "modify"); err != nil {
+		return
+	}
+	p.c.currule = n
+	p.c.nextaction = 0
+	if _, err = p.match(':'); err != nil {
+		return
+	}
+	for {
+		switch p.lh.kind {
+		case '+':
+			p.match('+')
+			var prod *Node
+			if prod, err = p.parseProd(); err != nil {
+				return
+			}
+			n.nodes = append(n.nodes, prod)
+		case '-':
+			pos := p.lh.pos
+			p.match('-')
+			var prod *Node
+			if prod, err = p.parseProd(); err != nil {
+				return
+			}
+			p.c.dropActions([]*Node{prod})
+			i := findProd(n.nodes, prod)
+			if i < 0 {
+				p.c.compileError(pos, "%s has no such production to remove.", s)
+				break
+			}
+			p.c.dropActions(n.nodes[i : i+1])
+			n.nodes = append(n.nodes[:i], n.nodes[i+1:]...)
+			if len(n.nodes) == 0 {
+				p.c.compileError(pos, "removing the last production of %s, use delete instead.", s)
+			}
+		default:
+			err = p.c.compileError(p.lh.pos, "expected + or - before production, found %s", p.lh)
+			return
+		}
+		if p.lh.kind != '|' {
+			break
+		}
+		p.match('|')
+	}
+	return
+}
+
+// findProd returns the index of the production in prods with the same
+// elements as prod, ignoring actions, or -1.
+func findProd(prods []*Node, prod *Node) int {
+	want := prodElems(prod)
+next:
+	for i, prod1 := range prods {
+		have := prodElems(prod1)
+		if len(have) != len(want) {
+			continue
+		}
+		for j := range have {
+			a, b := have[j], want[j]
+			// Forward references are still unresolved, compare names
+			if a != b && (a.sym == nil || a.sym != b.sym) {
+				continue next
+			}
+		}
+		return i
+	}
+	return -1
+}
+
+func prodElems(prod *Node) (l []*Node) {
+	for _, elem := range prod.nodes {
+		if actionOf(elem.left) == nil {
+			l = append(l, elem.left)
+		}
+	}
+	return
+}
+
 func (p *Parser) parseEscapeCode() (code []byte, err error) {
 	if !p.check(ESCOPEN) {
 		return
 	}
+	pos := p.lh.pos
 	p.lexer.raw()
 	for {
 		c := p.lexer.raw()
+		if c == 0 {
+			err = p.c.compileError(pos, "unterminated code block, missing @}.")
+			return
+		}
 		if c == '@' {
 			c2 := p.lexer.raw()
 			if c2 == '}' {
@@ -692,14 +1153,180 @@ func (p *Parser) parseEscapeCode() (code []byte, err error) {
 			}
 			p.lexer.putc(c2)
 		}
-		code = append(code, c)
+		code = utf8.AppendRune(code, c)
 	}
 	// reset the lh token
 	p.next()
 	return
 }
 
-func (p *Parser) parseGrammar() (n *Node, err error) {
+// parseImport loads the grammar named by an import declaration and makes
+// its rules and regdefs visible to the grammar being parsed.
+func (p *Parser) parseImport() (err error) {
+	pos := p.lh.pos
+	if _, err = p.match(IMPORT); err != nil {
+		return
+	}
+	var t *Token
+	if t, err = p.match(STRLIT); err != nil {
+		for p.lh.kind != ';' && p.lh.kind != EOF {
+			p.next()
+		}
+		p.match(';')
+		return
+	}
+	p.match(';')
+
+	path := p.findImport(t.lit.lit)
+	if path == "" {
+		err = p.c.compileError(pos, "cannot find imported grammar '%s'.", t.lit.lit)
+		return
+	}
+	var g *grammarFile
+	if g, err = p.loadGrammar(path, nil, pos, nil); err != nil {
+		return
+	}
+	p.lexer.gram.imports = append(p.lexer.gram.imports, g)
+	return
+}
+
+// findImport searches for an imported file next to the importing file,
+// then in every -I directory.
+func (p *Parser) findImport(name string) string {
+	dirs := append([]string{filepath.Dir(p.lexer.fileName)}, p.c.includes...)
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if p.c.isFile(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// open opens the grammar file name, in the file system of the options
+// when there is one.
+func (c *compiler) open(name string) (io.ReadCloser, error) {
+	if c.fsys != nil {
+		return c.fsys.Open(filepath.ToSlash(name))
+	}
+	return os.Open(name)
+}
+
+// isFile reports whether name is a file that open can open.
+func (c *compiler) isFile(name string) bool {
+	var fi fs.FileInfo
+	var err error
+	if c.fsys != nil {
+		fi, err = fs.Stat(c.fsys, filepath.ToSlash(name))
+	} else {
+		fi, err = os.Stat(name)
+	}
+	return err == nil && !fi.IsDir()
+}
+
+// loadGrammar parses file into a grammar of its own, or into ns when
+// file is the base of ns. The file is read from src, or opened when src
+// is nil. An imported file is only parsed once, later imports share the
+// first result.
+func (p *Parser) loadGrammar(file string, src io.Reader, pos *Position, ns *grammarFile) (g *grammarFile, err error) {
+	key, _ := filepath.Abs(file)
+	for _, g1 := range p.c.grammars {
+		if g1.file != key {
+			continue
+		}
+		if g1.loading {
+			// The grammars still loading form the chain of imports that
+			// led here. Report the cycle where it starts.
+			var chain []*grammarFile
+			for _, g2 := range p.c.grammars {
+				if g2.loading && (len(chain) > 0 || g2 == g1) {
+					chain = append(chain, g2)
+				}
+			}
+			if len(chain) > 1 {
+				pos = chain[1].pos
+			}
+			cycle := ""
+			for i, g2 := range chain {
+				verb := "imports"
+				if i+1 < len(chain) && chain[i+1].base || i+1 == len(chain) && ns != nil {
+					verb = "extends"
+				}
+				cycle += fmt.Sprintf("%s %s ", g2.name, verb)
+			}
+			err = p.c.compileError(pos, "import cycle: %s%s.", cycle, g1.name)
+			return
+		}
+		if ns == nil {
+			g = g1
+			return
+		}
+	}
+
+	g = consGrammar(filepath.Base(file))
+	g.file = key
+	g.pos = pos
+	g.imported = len(p.c.grammars) > 0
+	g.base = ns != nil
+	if ns == nil {
+		ns = g
+	}
+	if src == nil {
+		f, ferr := p.c.open(file)
+		if ferr != nil {
+			err = p.c.compileError(pos, "could not open %s.", file)
+			return
+		}
+		defer f.Close()
+		src = f
+	}
+	lexer := p.c.consLexer(file, src, ns)
+	p.c.grammars = append(p.c.grammars, g)
+
+	// Imports are parsed in the middle of the importing file, save
+	// everything that belongs to it.
+	savedLexer, savedLh := p.lexer, p.lh
+	savedGram, savedRule := p.c.curgram, p.c.currule
+	defer func() {
+		p.lexer, p.lh = savedLexer, savedLh
+		p.c.curgram, p.c.currule = savedGram, savedRule
+	}()
+
+	g.loading = true
+	p.lexer = lexer
+	p.lh = p.lexer.next()
+	g.top, err = p.parseGrammar(g)
+	g.loading = false
+	return
+}
+
+// parseExtend parses the base grammar named by s into the namespace of
+// the grammar being parsed, which inherits all of its declarations. The
+// base grammar is looked up as s.zb, like an import.
+func (p *Parser) parseExtend(s *Sym) (err error) {
+	path := p.findImport(s.name + ".zb")
+	if path == "" {
+		err = p.c.compileError(s.pos, "cannot find base grammar %s.", s)
+		return
+	}
+	var g *grammarFile
+	if g, err = p.loadGrammar(path, nil, s.pos, p.lexer.gram); err != nil || g.top == nil {
+		return
+	}
+
+	// The base grammar only keeps its code, its declarations now belong
+	// to the grammar extending it.
+	p.c.curgram.nodes = append(p.c.curgram.nodes, g.top.nodes...)
+	p.c.curgram.left = g.top.left
+	g.top.nodes = nil
+	g.top.left = nil
+	return
+}
+
+func (p *Parser) parseGrammar(g *grammarFile) (n *Node, err error) {
 	if _, err = p.match(GRAMMAR); err != nil {
 		return
 	}
@@ -708,24 +1335,50 @@ func (p *Parser) parseGrammar() (n *Node, err error) {
 	if s, err = p.parseTermName(); err != nil {
 		return
 	}
+	for _, g1 := range p.c.grammars {
+		if g1 != g && !g1.base && !g.base && g1.name == s.name {
+			err = p.c.compileError(s.pos, "grammar %s already loaded from %s.", s, g1.file)
+			return
+		}
+	}
+	g.name = s.name
 
 	n = newname(s)
 	n.op = OGRAM
 	n.nodes = make([]*Node, 0)
-	curgram = n
-	declare(n)
+	p.c.curgram = n
+	p.c.declare(n)
 
+	var base *Sym
+	if p.lh.kind == EXTEND {
+		p.match(EXTEND)
+		if base, err = p.parseTermName(); err != nil {
+			return
+		}
+	}
 	p.match(';')
 
+	if base != nil {
+		p.parseExtend(base)
+	}
+
 	if p.lh.kind == ESCOPEN {
 		if n.code, err = p.parseEscapeCode(); err != nil {
 			return
 		}
 	}
 
+	for p.lh.kind == IMPORT {
+		p.parseImport()
+	}
+
 	for p.lh.kind != EOF {
+		if p.lh.kind == LEXER {
+			p.parseLexerMode(n)
+			continue
+		}
 		var n2 *Node
-		if n2, err = p.parseDecl(); err != nil {
+		if n2, err = p.parseDecl(); err != nil || n2 == nil {
 			continue
 		}
 		n.nodes = append(n.nodes, n2)
@@ -739,24 +1392,23 @@ func (p *Parser) parseGrammar() (n *Node, err error) {
 	return
 }
 
-func (p *Parser) parse(f string) (n *Node) {
-	// 1. Create a lexer to scan the file.
-	var err error
-	p.lexer, err = consLexer(f)
-	if err != nil {
-		panic("could not open file")
+// parse parses the grammar named f, read from src or from the file f when
+// src is nil.
+func (p *Parser) parse(f string, src io.Reader) (n *Node) {
+	// 1. Parse the file and everything it imports
+	p.c.numSavedErrs = 0
+	g, err := p.loadGrammar(f, src, nil, nil)
+	if g == nil {
+		// loadGrammar reported why
+		return
 	}
-	numSavedErrs = 0
-	p.lh = p.lexer.next()
-
-	// 2. Parse the file, exiting if any errors were encountered
-	if n, err = p.parseGrammar(); err != nil {
+	if n = g.top; err != nil || n == nil {
 		return
 	}
 
-	// 3. Check to make sure we have a start rule
+	// 2. Check to make sure we have a start rule
 	if n.left == nil {
-		compileError(n.pos, "grammar must define a start rule.")
+		p.c.compileError(n.pos, "grammar must define a start rule.")
 	}
 
 	return
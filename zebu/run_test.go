@@ -0,0 +1,237 @@
+// run_test.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The grammars of the test directory starting with // run are compiled,
+// and the generated parser is built and run on the inputs listed in the
+// grammar, as in
+//
+//	// INPUT "1 + 2"
+//	// OUTPUT 3
+//
+// The OUTPUT lines after an INPUT are what parsing it must print: the
+// value of the start rule, or ok when it has no type, or one line
+// "error: ..." for each syntax error. Without a -backend flag the parser
+// of every backend is run. test/check.rb runs the same grammars.
+
+// runDriver is the main package calling the generated parser on its
+// argument.
+const runDriver = `package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	%s
+	if l, ok := err.(ZbErrorList); ok {
+		for _, e := range l {
+			fmt.Println("error:", e)
+		}
+	} else if err != nil {
+		fmt.Println("error:", err)
+	}
+}
+`
+
+// runCase is an input of a run grammar and the lines parsing it prints.
+type runCase struct {
+	input  string
+	output []string
+}
+
+var runPackage = regexp.MustCompile(`(?m)^package \w+$`)
+
+func TestRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	files, _ := filepath.Glob("../test/*.zb")
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil || !bytes.HasPrefix(src, []byte("// run")) {
+			continue
+		}
+		backends, opts, cases, err := runSpec(src)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		for _, backend := range backends {
+			file, opts, backend := file, opts, backend
+			opts.Backend = backend
+			t.Run(filepath.Base(file)+"/"+backend, func(t *testing.T) {
+				t.Parallel()
+				runGrammar(t, file, opts, cases)
+			})
+		}
+	}
+}
+
+// runSpec reads the flags of the first line of a run grammar and its
+// inputs.
+func runSpec(src []byte) (backends []string, opts Options, cases []runCase, err error) {
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	sc.Scan()
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.Var((*pathList)(&backends), "backend", "")
+	fs.BoolVar(&opts.Werror, "Werror", false, "")
+	opts.Checks = make(map[string]bool)
+	fs.Func("W", "", func(s string) error {
+		on := !strings.HasPrefix(s, "no-")
+		check := strings.TrimPrefix(s, "no-")
+		if check != "all" {
+			opts.Checks[check] = on
+			return nil
+		}
+		for check := range lintChecks {
+			opts.Checks[check] = on
+		}
+		return nil
+	})
+	if err = fs.Parse(strings.Fields(sc.Text())[2:]); err != nil {
+		return
+	}
+	if len(backends) == 0 {
+		backends = []string{"rd", "table", "lalr", "earley"}
+	}
+
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "// INPUT "):
+			var in string
+			if in, err = strconv.Unquote(strings.TrimPrefix(line, "// INPUT ")); err != nil {
+				return
+			}
+			cases = append(cases, runCase{input: in})
+		case strings.HasPrefix(line, "// OUTPUT ") && len(cases) > 0:
+			c := &cases[len(cases)-1]
+			c.output = append(c.output, strings.TrimPrefix(line, "// OUTPUT "))
+		}
+	}
+	return
+}
+
+func runGrammar(t *testing.T, file string, opts Options, cases []runCase) {
+	prog := runBuild(t, file, opts, func(code []byte) string {
+		call := "result, err := Parse(strings.NewReader(os.Args[1]))\nif err == nil {\nfmt.Println(result)\n}"
+		if bytes.Contains(code, []byte("func Parse(r io.Reader) (err error)")) {
+			call = "err := Parse(strings.NewReader(os.Args[1]))\nif err == nil {\nfmt.Println(\"ok\")\n}"
+		}
+		return strings.Replace(runDriver, "%s", call, 1)
+	})
+	for _, c := range cases {
+		out, err := exec.Command(prog, c.input).CombinedOutput()
+		if err != nil {
+			t.Errorf("%q: %v\n%s", c.input, err, out)
+			continue
+		}
+		got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		if strings.Join(got, "\n") != strings.Join(c.output, "\n") {
+			t.Errorf("%q: got\n\t%s\nwant\n\t%s", c.input, strings.Join(got, "\n\t"), strings.Join(c.output, "\n\t"))
+		}
+	}
+}
+
+// runBuild builds the parser generated from file with driver, the main
+// package given the generated code, and returns the program.
+func runBuild(t *testing.T, file string, opts Options, driver func(code []byte) string) string {
+	res, err := Compile(nil, file, opts)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	dir := t.TempDir()
+	code := runPackage.ReplaceAll(res.Code, []byte("package main"))
+	for name, data := range map[string][]byte{
+		"zb.go":   code,
+		"main.go": []byte(driver(code)),
+		"go.mod":  []byte("module zbrun\n\ngo 1.21\n"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := exec.Command("go", "build", "-o", "zbrun", ".")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=", "GOTOOLCHAIN=local")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return filepath.Join(dir, "zbrun")
+}
+
+// earleyDriver prints what the forest of its argument tells, then the
+// values of the derivations picked by the default choice and by choosing
+// the last alternative of every node.
+const earleyDriver = `package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	forest, err := ParseForest(strings.NewReader(os.Args[1]))
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	fmt.Println("ambiguous:", forest.Ambiguous())
+	fmt.Println("trees:", len(forest.Trees()))
+	first, err := ParseChoose(strings.NewReader(os.Args[1]), nil)
+	fmt.Println("first:", first, err)
+	last, err := ParseChoose(strings.NewReader(os.Args[1]), func(n *ZbNode) int {
+		return len(n.Alts) - 1
+	})
+	fmt.Println("last:", last, err)
+}
+`
+
+func TestEarleyForest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	prog := runBuild(t, "../test/earley_ambig.zb", Options{Backend: "earley"}, func([]byte) string {
+		return earleyDriver
+	})
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{"7", "ambiguous: false\ntrees: 1\nfirst: 7 <nil>\nlast: 7 <nil>"},
+		// 7-(3-1) and (7-3)-1
+		{"7-3-1", "ambiguous: true\ntrees: 2\nfirst: 5 <nil>\nlast: 3 <nil>"},
+		// 9-(5-(3-1)) and ((9-5)-3)-1 of the 5 ways to group it
+		{"9-5-3-1;", "ambiguous: true\ntrees: 5\nfirst: 6 <nil>\nlast: 0 <nil>"},
+	} {
+		out, err := exec.Command(prog, tc.input).CombinedOutput()
+		if got := strings.TrimSuffix(string(out), "\n"); err != nil || got != tc.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", tc.input, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// table.go
+// Copyright 2015 The Zebu Authors. All rights reserved.
+//
+package zebu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The table backend emits the same LL(1) parser as the recursive descent
+// backend, but as data interpreted by a small driver. Every production
+// becomes a list of steps (match a token, parse a rule, run an action) and
+// every rule gets a predict table choosing its production from the
+// lookahead. The driver keeps one frame per production being parsed on a
+// heap allocated stack, so deeply nested input cannot overflow the
+// goroutine stack.
+//
+// A frame holds what the rule function holds in the recursive descent
+// backend: the rule result, its parameters and the values of its elements.
+// Each of those gets a slot, parameters first.
+
+// Special slots of a step
+const (
+	slotResult = -1 // the result of the frame
+	slotNone   = -2 // the value is not used
+)
+
+// tableAction is an action of the table, found at element i of prod in
+// rule g.
+type tableAction struct {
+	g, prod  *Node
+	i        int
+	a        *Node
+	assigned bool // whether $$ was set earlier in prod
+}
+
+// tableRules returns the rules parsed by the table, in table order.
+func tableRules(top *Node) (rules []*Node, index map[*Node]int) {
+	index = make(map[*Node]int)
+	for _, n := range top.nodes {
+		if n.op != ORULE || actionOf(n) != nil {
+			continue
+		}
+		index[n] = len(rules)
+		rules = append(rules, n)
+	}
+	return
+}
+
+// tableSlots numbers the values kept in a frame of rule g.
+func (c *compiler) tableSlots(g *Node) map[*Node]int {
+	slots := make(map[*Node]int)
+	for _, d := range c.params(g) {
+		slots[d] = len(slots)
+	}
+	for _, prod := range g.nodes {
+		for _, elem := range prod.nodes {
+			if c.elemUsed(elem) {
+				slots[elem] = len(slots)
+			}
+		}
+	}
+	return slots
+}
+
+// tableSlot returns the slot holding the value of d at element i of prod
+// in rule g.
+func (c *compiler) tableSlot(g *Node, prod *Node, i int, d *Node, assigned bool, slots map[*Node]int) int {
+	if c.dclValue(g, prod, i, d, assigned) == "result" {
+		return slotResult
+	}
+	return slots[d]
+}
+
+func (c *compiler) tableDump(top *Node) {
+	rules, index := tableRules(top)
+	start := top.left
+
+	// 1. Driver types
+	fmt.Fprintf(c.codeout, "const (\n")
+	fmt.Fprintf(c.codeout, "zbMatch = iota\n")
+	fmt.Fprintf(c.codeout, "zbCall\n")
+	fmt.Fprintf(c.codeout, "zbAction\n")
+	fmt.Fprintf(c.codeout, "zbAccept\n")
+	fmt.Fprintf(c.codeout, ")\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "type zbStep struct {\n")
+	fmt.Fprintf(c.codeout, "op int\n")
+	fmt.Fprintf(c.codeout, "kind ZbTokenKind\n")
+	fmt.Fprintf(c.codeout, "n int // rule or action\n")
+	fmt.Fprintf(c.codeout, "slot int // where the value goes, -1 for the result\n")
+	fmt.Fprintf(c.codeout, "args []int // slots passed to the rule\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "type zbFrame struct {\n")
+	fmt.Fprintf(c.codeout, "rule, prod, pc int\n")
+	fmt.Fprintf(c.codeout, "result interface{}\n")
+	fmt.Fprintf(c.codeout, "vals []interface{}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 2. Tables
+	nprod := 0
+	actions := make([]tableAction, 0)
+	fmt.Fprintf(c.codeout, "var zbProds = [...][]zbStep{\n")
+	for _, g := range rules {
+		slots := c.tableSlots(g)
+		for _, prod := range g.nodes {
+			fmt.Fprintf(c.codeout, "// %d: %s\n", nprod, g.sym)
+			fmt.Fprintf(c.codeout, "{")
+			c.tableProdDump(g, prod, slots, index, &actions)
+			fmt.Fprintf(c.codeout, "},\n")
+			nprod++
+		}
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbRuleVals = [...]int{")
+	for i, g := range rules {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		fmt.Fprintf(c.codeout, "%d", len(c.tableSlots(g)))
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// A nullable production is chosen whenever no other production
+	// applies, so it becomes the default.
+	defaults := make([]int, 0, len(rules))
+	nprod = 0
+	fmt.Fprintf(c.codeout, "var zbPredict = [...]map[ZbTokenKind]int{\n")
+	for _, g := range rules {
+		def := -1
+		fmt.Fprintf(c.codeout, "{")
+		for _, prod := range g.nodes {
+			firsts, nullable := c.prodFirst(prod)
+			if nullable && def < 0 {
+				def = nprod
+			} else {
+				for _, n1 := range firsts {
+					fmt.Fprintf(c.codeout, "%s: %d, ", c.caseFriendly(n1), nprod)
+				}
+			}
+			nprod++
+		}
+		fmt.Fprintf(c.codeout, "}, // %s\n", g.sym)
+		defaults = append(defaults, def)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbDefault = [...]int{")
+	for i, def := range defaults {
+		if i > 0 {
+			fmt.Fprintf(c.codeout, ", ")
+		}
+		fmt.Fprintf(c.codeout, "%d", def)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "var zbFollow = [...][]ZbTokenKind{\n")
+	for _, g := range rules {
+		fmt.Fprintf(c.codeout, "{%s}, // %s\n", strings.Join(c.followKinds(g), ", "), g.sym)
+	}
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 3. Parse
+	c.parseFileDump(top)
+	fmt.Fprintf(c.codeout, "if err = p.advance(); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	if start.ntype != nil {
+		fmt.Fprintf(c.codeout, "var v interface{}\n")
+		fmt.Fprintf(c.codeout, "if v, err = p.run(%d); err != nil {\n", index[start])
+		fmt.Fprintf(c.codeout, "return\n")
+		fmt.Fprintf(c.codeout, "}\n")
+		fmt.Fprintf(c.codeout, "result, _ = v.(%s)\n", start.ntype.typ)
+	} else {
+		fmt.Fprintf(c.codeout, "if _, err = p.run(%d); err != nil {\n", index[start])
+		fmt.Fprintf(c.codeout, "return\n")
+		fmt.Fprintf(c.codeout, "}\n")
+	}
+	fmt.Fprintf(c.codeout, "if p.lookahead.kind != ZBEOF {\n")
+	fmt.Fprintf(c.codeout, "err = p.unexpected(ZBEOF)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 4. Driver
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) predict(rule int) (f *zbFrame, err error) {\n")
+	fmt.Fprintf(c.codeout, "prod, ok := zbPredict[rule][p.lookahead.kind]\n")
+	fmt.Fprintf(c.codeout, "if !ok {\n")
+	fmt.Fprintf(c.codeout, "prod = zbDefault[rule]\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "if prod < 0 {\n")
+	fmt.Fprintf(c.codeout, "expected := make([]ZbTokenKind, 0, len(zbPredict[rule]))\n")
+	fmt.Fprintf(c.codeout, "for kind := range zbPredict[rule] {\n")
+	fmt.Fprintf(c.codeout, "expected = append(expected, kind)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "err = p.unexpected(expected...)\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "f = &zbFrame{rule: rule, prod: prod, vals: make([]interface{}, zbRuleVals[rule])}\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "func (f *zbFrame) load(slot int) interface{} {\n")
+	fmt.Fprintf(c.codeout, "if slot < 0 {\n")
+	fmt.Fprintf(c.codeout, "return f.result\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "return f.vals[slot]\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	fmt.Fprintf(c.codeout, "func (f *zbFrame) store(slot int, v interface{}) {\n")
+	fmt.Fprintf(c.codeout, "switch {\n")
+	fmt.Fprintf(c.codeout, "case slot == %d:\n", slotResult)
+	fmt.Fprintf(c.codeout, "f.result = v\n")
+	fmt.Fprintf(c.codeout, "case slot >= 0:\n")
+	fmt.Fprintf(c.codeout, "f.vals[slot] = v\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// A syntax error ends the production being parsed, like the return
+	// of a rule function of the recursive descent backend.
+	fmt.Fprintf(c.codeout, "// run parses rule, keeping the productions being parsed on a stack.\n")
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) run(rule int) (result interface{}, err error) {\n")
+	fmt.Fprintf(c.codeout, "f, err := p.predict(rule)\n")
+	fmt.Fprintf(c.codeout, "if err != nil {\n")
+	fmt.Fprintf(c.codeout, "p.sync(&err, zbFollow[rule]...)\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "stack := []*zbFrame{f}\n")
+	fmt.Fprintf(c.codeout, "for {\n")
+	fmt.Fprintf(c.codeout, "f = stack[len(stack)-1]\n")
+	fmt.Fprintf(c.codeout, "steps := zbProds[f.prod]\n")
+	fmt.Fprintf(c.codeout, "if f.pc == len(steps) {\n")
+	fmt.Fprintf(c.codeout, "stack = stack[:len(stack)-1]\n")
+	fmt.Fprintf(c.codeout, "if len(stack) == 0 {\n")
+	fmt.Fprintf(c.codeout, "return f.result, nil\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "caller := stack[len(stack)-1]\n")
+	fmt.Fprintf(c.codeout, "caller.store(zbProds[caller.prod][caller.pc-1].slot, f.result)\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "s := &steps[f.pc]\n")
+	fmt.Fprintf(c.codeout, "f.pc++\n")
+	fmt.Fprintf(c.codeout, "switch s.op {\n")
+	fmt.Fprintf(c.codeout, "case zbMatch:\n")
+	fmt.Fprintf(c.codeout, "var tok *ZbToken\n")
+	fmt.Fprintf(c.codeout, "if tok, err = p.expect(s.kind); err != nil {\n")
+	fmt.Fprintf(c.codeout, "if p.sync(&err, zbFollow[f.rule]...); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "f.pc = len(steps)\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "f.store(s.slot, tok.val)\n")
+	fmt.Fprintf(c.codeout, "case zbCall:\n")
+	fmt.Fprintf(c.codeout, "var callee *zbFrame\n")
+	fmt.Fprintf(c.codeout, "if callee, err = p.predict(s.n); err != nil {\n")
+	fmt.Fprintf(c.codeout, "if p.sync(&err, zbFollow[s.n]...); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "continue\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "for i, slot := range s.args {\n")
+	fmt.Fprintf(c.codeout, "callee.vals[i] = f.load(slot)\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "stack = append(stack, callee)\n")
+	fmt.Fprintf(c.codeout, "case zbAction:\n")
+	fmt.Fprintf(c.codeout, "if err = p.action(s.n, f); err != nil {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "case zbAccept:\n")
+	fmt.Fprintf(c.codeout, "f.result = f.vals[0]\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+
+	// 5. Actions, each one reads its values out of the frame
+	fmt.Fprintf(c.codeout, "func (p *ZbParser) action(n int, f *zbFrame) (err error) {\n")
+	fmt.Fprintf(c.codeout, "if len(p.errs) > 0 {\n")
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	if len(actions) > 0 {
+		fmt.Fprintf(c.codeout, "switch n {\n")
+		for k, ta := range actions {
+			c.tableActionDump(k, ta)
+		}
+		fmt.Fprintf(c.codeout, "}\n")
+	}
+	fmt.Fprintf(c.codeout, "return\n")
+	fmt.Fprintf(c.codeout, "}\n")
+	fmt.Fprintf(c.codeout, "\n")
+}
+
+// tableProdDump writes the steps of prod in rule g. Actions are added to
+// actions as they are numbered.
+func (c *compiler) tableProdDump(g *Node, prod *Node, slots map[*Node]int, index map[*Node]int, actions *[]tableAction) {
+	steps := make([]string, 0, len(prod.nodes))
+	assigned := false
+	if g.acc != nil && g.ntype != nil && len(prod.nodes) == 1 && prod.nodes[0].left.op == OEPSILON {
+		steps = append(steps, "{op: zbAccept}")
+	}
+	for i, n1 := range prod.nodes {
+		e := n1.left
+		if a := actionOf(e); a != nil {
+			steps = append(steps, fmt.Sprintf("{op: zbAction, n: %d}", len(*actions)))
+			*actions = append(*actions, tableAction{g, prod, i, a, assigned})
+			assigned = true
+			continue
+		}
+		switch e.op {
+		case OSTRLIT, OREGDEF:
+			slot := slotNone
+			if c.elemUsed(n1) {
+				slot = slots[n1]
+			}
+			steps = append(steps, fmt.Sprintf("{op: zbMatch, kind: %s, slot: %d}", c.caseFriendly(e), slot))
+		case ORULE:
+			args := make([]string, 0)
+			for _, d := range c.params(e) {
+				args = append(args, fmt.Sprint(c.tableSlot(g, prod, i, d, assigned, slots)))
+			}
+			slot := slotNone
+			switch {
+			case e.orig != nil && e.ntype != nil && e.root() == g.root():
+				slot = slotResult
+				assigned = true
+			case e.ntype != nil && c.elemUsed(n1):
+				slot = slots[n1]
+			}
+			step := fmt.Sprintf("{op: zbCall, n: %d, slot: %d", index[e], slot)
+			if len(args) > 0 {
+				step += fmt.Sprintf(", args: []int{%s}", strings.Join(args, ", "))
+			}
+			steps = append(steps, step+"}")
+		}
+	}
+	fmt.Fprintf(c.codeout, "%s", strings.Join(steps, ", "))
+}
+
+// tableActionDump writes the k-th action of the table. The values it
+// reads are copied out of the frame into variables named the way the
+// recursive descent backend names them, and the result is copied back.
+func (c *compiler) tableActionDump(k int, ta tableAction) {
+	buf, refs := c.actionText(ta.g, ta.prod, ta.i, ta.a, ta.assigned)
+	slots := c.tableSlots(ta.g)
+	fmt.Fprintf(c.codeout, "case %d:\n", k)
+	result := false
+	for _, d := range refs {
+		if d == nil {
+			result = true
+			fmt.Fprintf(c.codeout, "result, _ := f.result.(%s)\n", ta.g.ntype.typ)
+			continue
+		}
+		typ, _ := dclType(d)
+		fmt.Fprintf(c.codeout, "%s, _ := f.vals[%d].(%s)\n", c.dclName(d), slots[d], typ)
+	}
+	fmt.Fprintf(c.codeout, "{\n%s\n}\n", buf)
+	if result {
+		fmt.Fprintf(c.codeout, "f.result = result\n")
+	}
+}
@@ -3,138 +3,511 @@ package zebu
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"text/tabwriter"
 )
 
 // Debug, erase when done
 var _ = fmt.Printf
 
-func primeName(name string) string {
-	namep := name
-	s := symbols.lookup(namep)
+// primeName returns the first unused primed variant of sym in the grammar
+// declaring it.
+func (c *compiler) primeName(sym *Sym) *Sym {
+	namep := sym.name
+	s := c.symbols.lookupGrammar(namep, sym.gram)
 	for s.defn != nil {
 		namep = fmt.Sprintf("%s'", namep)
-		s = symbols.lookup(namep)
+		s = c.symbols.lookupGrammar(namep, sym.gram)
 	}
-	return namep
+	return s
 }
 
-func leftFactor(top *Node) {
+func (c *compiler) leftFactor(top *Node) {
 	for _, dcl := range top.nodes {
 		if dcl.op != ORULE {
 			continue
 		}
+		c.leftFactorRule(top, dcl)
+	}
+}
 
-		// First pass to categorize our possible left factor paths
-		paths := make(map[*Node][]*Node)
+// leftFactorRule factors the common prefixes out of the productions of
+// dcl, declaring a new rule for each set of remainders.
+func (c *compiler) leftFactorRule(top *Node, dcl *Node) {
+	// First pass to categorize our possible left factor paths, kept in
+	// the order of their first production so the output is the same
+	// from run to run
+	paths := make(map[*Node][]*Node)
+	order := make([]*Node, 0)
 
-		for _, prod := range dcl.nodes {
-			fst := prod.nodes[0].left
-			paths[fst] = append(paths[fst], prod)
+	for _, prod := range dcl.nodes {
+		fst := prod.nodes[0].left
+		if _, ok := paths[fst]; !ok {
+			order = append(order, fst)
 		}
+		paths[fst] = append(paths[fst], prod)
+	}
 
-		newProds := make([]*Node, 0)
+	newProds := make([]*Node, 0)
 
-		for _, set := range paths {
-			if len(set) <= 1 {
-				newProds = append(newProds, set[0])
-				continue
-			}
+	for _, fst := range order {
+		set := paths[fst]
+		if len(set) <= 1 {
+			newProds = append(newProds, set[0])
+			continue
+		}
 
-			// Grab the greatest common left factor for each production
-			// Set will save the state of our iteration
-			common := make([]*Node, 0)
+		// Grab the greatest common left factor for each production
+		// Set will save the state of our iteration
+		common := make([]*Node, 0)
 
-			factors := make([][]*Node, 0, len(set))
-			for i := 0; i < len(set); i++ {
-				factors = append(factors, set[i].nodes)
-			}
+		factors := make([][]*Node, 0, len(set))
+		for i := 0; i < len(set); i++ {
+			factors = append(factors, set[i].nodes)
+		}
 
-			last := -1
-		nomorecommon:
-			for i := 0; i < len(factors[0]); i++ {
-				for j := 1; j < len(factors); j++ {
-					if i >= len(factors[j]) || factors[0][i].left != factors[j][i].left {
-						break nomorecommon
-					}
+		last := -1
+	nomorecommon:
+		for i := 0; i < len(factors[0]); i++ {
+			for j := 1; j < len(factors); j++ {
+				if i >= len(factors[j]) || factors[0][i].left != factors[j][i].left {
+					break nomorecommon
 				}
-				common = append(common, factors[0][i])
-				last = i
-			}
-			if last == -1 {
-				panic("nothing found in common after determing a common path")
 			}
+			common = append(common, factors[0][i])
+			last = i
+		}
+		if last == -1 {
+			panic("nothing found in common after determing a common path")
+		}
 
-			// CODE : I don't like how nodeRuleFromFactoring is used,
-			// doesn't really make sense to have a cons, come back to fix
-			for i := 0; i < len(factors); i++ {
-				if last >= len(factors[i]) {
-					continue
-				}
-				factors[i] = factors[i][last+1:]
+		// Actions moved with the remainders still refer to the
+		// elements of their own production; point them at the
+		// elements that survive in the common prefix.
+		for j := 1; j < len(factors); j++ {
+			for i := 0; i <= last; i++ {
+				redirectDcl(factors[j][last+1:], factors[j][i], common[i])
 			}
+		}
 
-			// create a new rule for the common elems, and factor
-			// out from each node
-			fact := nodeRuleFromFactoring(dcl, factors)
-			top.nodes = append(top.nodes, fact)
+		// CODE : I don't like how nodeRuleFromFactoring is used,
+		// doesn't really make sense to have a cons, come back to fix
+		for i := 0; i < len(factors); i++ {
+			if last >= len(factors[i]) {
+				continue
+			}
+			factors[i] = factors[i][last+1:]
+		}
 
-			// CODE : Maybe pull this into a cons? I don't like how it
-			// is very specific, it basically becomes a function for this
-			// use only
-			newProds = append(newProds, &Node{
-				op: OPROD,
-				nodes: append(common, &Node{
-					op:   OPRODDCL,
-					left: fact,
-				}),
-			})
+		// create a new rule for the common elems, and factor
+		// out from each node
+		fact := c.nodeRuleFromFactoring(dcl, factors)
+		for i, prod := range fact.nodes {
+			prod.pos = set[i].pos
 		}
+		top.nodes = append(top.nodes, fact)
+
+		// CODE : Maybe pull this into a cons? I don't like how it
+		// is very specific, it basically becomes a function for this
+		// use only
+		newProds = append(newProds, &Node{
+			op: OPROD,
+			nodes: append(common, &Node{
+				op:   OPRODDCL,
+				left: fact,
+			}),
+			pos: set[0].pos,
+		})
+	}
+
+	dcl.nodes = newProds
+}
 
-		dcl.nodes = newProds
+// redirectDcl makes every action among elems that depends on from depend
+// on to instead.
+func redirectDcl(elems []*Node, from *Node, to *Node) {
+	if from == to {
+		return
+	}
+	for _, elem := range elems {
+		a := actionOf(elem.left)
+		if a == nil {
+			continue
+		}
+		for k, d := range a.dpn {
+			if d == from {
+				a.dpn[k] = to
+				to.used = true
+			}
+		}
 	}
 }
 
-func removeDirectRecursion(top *Node) {
+func (c *compiler) removeDirectRecursion(top *Node) {
 	for _, dcl := range top.nodes {
 		if dcl.op != ORULE {
 			continue
 		}
+		c.removeDirectRecursionRule(top, dcl)
+	}
+}
+
+// removeDirectRecursionRule rewrites the left recursive production of dcl,
+// if any, into a right recursive rule of its own. dcl must be left
+// factored.
+func (c *compiler) removeDirectRecursionRule(top *Node, dcl *Node) {
+	nonRec := make([]*Node, 0)
+	var leftRec *Node = nil
+
+	for _, prod := range dcl.nodes {
+		fst := prod.nodes[0]
+		switch {
+		case fst.left == dcl:
+			if leftRec != nil {
+				panic(fmt.Sprintf("multiple left recursion found for %s. left factoring should prevent this.", dcl.sym))
+			}
+			leftRec = prod
+		default:
+			nonRec = append(nonRec, prod)
+		}
+	}
+	if leftRec == nil {
+		return
+	}
+
+	rule := c.nodeRuleFromLeftRecursion(dcl, leftRec)
+	top.nodes = append(top.nodes, rule)
 
-		nonRec := make([]*Node, 0)
-		var leftRec *Node = nil
+	for _, prod := range nonRec {
+		prod.nodes = append(prod.nodes, rule.prodDcl())
+	}
 
+	dcl.nodes = nonRec
+}
+
+// removeIndirectRecursion removes left recursion running through more than
+// one rule by ordered substitution. The rules of each left recursive cycle
+// are put in order, a production starting with an earlier rule of the cycle
+// is replaced by the productions of that rule, and the direct recursion
+// this leaves behind is removed before moving on to the next rule. A rule
+// deriving itself, or left recursion hidden behind a prefix that derives
+// the empty string, cannot be removed this way and is reported.
+func (c *compiler) removeIndirectRecursion(top *Node) {
+	rules := make([]*Node, 0)
+	for _, dcl := range top.nodes {
+		if dcl.op == ORULE {
+			rules = append(rules, dcl)
+		}
+	}
+	nullable := nullableRules(rules)
+	reach := reachableRules(top)
+	ndcls := len(top.nodes)
+
+	// 1. The left corner graph has an edge from a rule to every rule that
+	// can start one of its productions. The edges hidden behind a nullable
+	// prefix, and those where the rest of the production is nullable too,
+	// are remembered.
+	corner := make(map[*Node][]*Node)
+	unit := make(map[*Node][]*Node)
+	hidden := make(map[*Node]map[*Node]*Node)
+	for _, dcl := range rules {
+		hidden[dcl] = make(map[*Node]*Node)
 		for _, prod := range dcl.nodes {
-			fst := prod.nodes[0]
-			switch {
-			case fst.left == dcl:
-				if leftRec != nil {
-					panic(fmt.Sprintf("multiple left recursion found for %s. left factoring should prevent this.", dcl.sym))
+			var prefix *Node
+			for i, elem := range prod.nodes {
+				e := elem.left
+				if e.op == OEPSILON {
+					continue
 				}
-				leftRec = prod
-			default:
-				nonRec = append(nonRec, prod)
+				if e.op != ORULE {
+					break
+				}
+				corner[dcl] = append(corner[dcl], e)
+				if prefix != nil && hidden[dcl][e] == nil {
+					hidden[dcl][e] = prefix
+				}
+				if nullableElems(prod.nodes[i+1:], nullable) {
+					unit[dcl] = append(unit[dcl], e)
+				}
+				if !nullable[e] {
+					break
+				}
+				if prefix == nil {
+					prefix = e
+				}
+			}
+		}
+	}
+
+	// 2. Cycles of rules deriving themselves
+	cyclic := make(map[*Node]bool)
+	for _, comp := range components(rules, unit) {
+		if len(comp) == 1 && !hasEdge(unit, comp[0], comp[0]) {
+			continue
+		}
+		for _, dcl := range comp {
+			c.compileError(dcl.pos, "%s can derive itself, which no parser can handle", dcl.sym)
+			cyclic[dcl] = true
+		}
+	}
+
+	// 3. Left recursive cycles
+	for _, comp := range components(rules, corner) {
+		if len(comp) == 1 && !hasEdge(corner, comp[0], comp[0]) || cyclic[comp[0]] {
+			continue
+		}
+		in := make(map[*Node]bool)
+		for _, dcl := range comp {
+			in[dcl] = true
+		}
+		ok := true
+		for _, dcl := range comp {
+			for e, prefix := range hidden[dcl] {
+				if !in[e] {
+					continue
+				}
+				if actionOf(prefix) != nil {
+					c.compileError(dcl.pos, "left recursion of %s through %s is hidden behind an action", dcl.sym, e.sym)
+				} else {
+					c.compileError(dcl.pos, "left recursion of %s through %s is hidden behind %s, which can derive the empty string", dcl.sym, e.sym, prefix.sym)
+				}
+				ok = false
 			}
 		}
-		if leftRec == nil {
+		if !ok || len(comp) == 1 {
 			continue
 		}
 
-		rule := nodeRuleFromLeftRecursion(dcl, leftRec)
+		// Typed rules go last: a rule substituted into another loses the
+		// actions computing its value.
+		sort.SliceStable(comp, func(i, j int) bool {
+			return comp[i].ntype == nil && comp[j].ntype != nil
+		})
+		for i, ai := range comp {
+			for _, aj := range comp[:i] {
+				prods := make([]*Node, 0, len(ai.nodes))
+				for _, prod := range ai.nodes {
+					if prod.nodes[0].left != aj {
+						prods = append(prods, prod)
+						continue
+					}
+					if aj.ntype != nil {
+						c.compileError(ai.pos, "cannot remove the left recursion of %s through %s, which has a type; try -backend=lalr", ai.sym, aj.sym)
+						prods = append(prods, prod)
+						continue
+					}
+					for _, sub := range aj.nodes {
+						prods = append(prods, c.substituteProd(top, sub, prod))
+					}
+				}
+				ai.nodes = prods
+			}
+			c.leftFactorRule(top, ai)
+			c.removeDirectRecursionRule(top, ai)
+		}
+	}
+
+	// 4. Substitution can leave rules of a cycle unused, and they would
+	// still take part in the LL(1) check.
+	if len(top.nodes) == ndcls {
+		return
+	}
+	now := reachableRules(top)
+	dcls := make([]*Node, 0, len(top.nodes))
+	for i, dcl := range top.nodes {
+		if dcl.op == ORULE && !now[dcl] && (reach[dcl] || i >= ndcls) {
+			continue
+		}
+		dcls = append(dcls, dcl)
+	}
+	top.nodes = dcls
+}
+
+// reachableRules returns the rules used, directly or not, by the start
+// rule of top.
+func reachableRules(top *Node) map[*Node]bool {
+	reach := make(map[*Node]bool)
+	var walk func(dcl *Node)
+	walk = func(dcl *Node) {
+		if reach[dcl] {
+			return
+		}
+		reach[dcl] = true
+		for _, prod := range dcl.nodes {
+			for _, elem := range prod.nodes {
+				if elem.left.op == ORULE {
+					walk(elem.left)
+				}
+			}
+		}
+	}
+	walk(top.left)
+	return reach
+}
+
+// substituteProd returns prod with its first element replaced by copies
+// of the elements of sub.
+func (c *compiler) substituteProd(top *Node, sub *Node, prod *Node) *Node {
+	rest := prod.nodes[1:]
+	elems := make([]*Node, 0, len(sub.nodes)+len(rest))
+	for _, elem := range sub.nodes {
+		if elem.left.op != OEPSILON {
+			elems = append(elems, elem)
+		}
+	}
+	elems = c.cloneElems(top, append(elems, rest...))
+	if len(elems) == 0 {
+		elems = append(elems, nepsilon.prodDcl())
+	}
+	return &Node{
+		op:    OPROD,
+		nodes: elems,
+		pos:   prod.pos,
+	}
+}
+
+// cloneElems copies elems, and the actions among them, so the copies can
+// be placed in a production of their own. The copied actions depend on the
+// copied elements and are declared in top.
+func (c *compiler) cloneElems(top *Node, elems []*Node) []*Node {
+	copies := make(map[*Node]*Node)
+	clones := make([]*Node, 0, len(elems))
+	for _, elem := range elems {
+		e := *elem
+		copies[elem] = &e
+		clones = append(clones, &e)
+	}
+	for _, e := range clones {
+		a := actionOf(e.left)
+		if a == nil {
+			continue
+		}
+		ca := *a
+		ca.dpn = make([]*Node, len(a.dpn))
+		for k, d := range a.dpn {
+			if copies[d] != nil {
+				d = copies[d]
+			}
+			ca.dpn[k] = d
+		}
+		ca.sym = c.primeName(e.left.sym)
+		rule := &Node{
+			op:  ORULE,
+			sym: ca.sym,
+			pos: e.left.pos,
+			nodes: []*Node{&Node{
+				op: OPROD,
+				nodes: []*Node{&Node{
+					op:    OPRODDCL,
+					left:  nepsilon,
+					right: &ca,
+				}},
+			}},
+		}
+		c.declare(rule)
 		top.nodes = append(top.nodes, rule)
+		e.left = rule
+	}
+	return clones
+}
 
-		for _, prod := range nonRec {
-			prod.nodes = append(prod.nodes, rule.prodDcl())
+// nullableRules returns the rules that can derive the empty string.
+func nullableRules(rules []*Node) map[*Node]bool {
+	nullable := make(map[*Node]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, dcl := range rules {
+			if nullable[dcl] {
+				continue
+			}
+			for _, prod := range dcl.nodes {
+				if nullableElems(prod.nodes, nullable) {
+					nullable[dcl] = true
+					changed = true
+					break
+				}
+			}
 		}
+	}
+	return nullable
+}
 
-		dcl.nodes = nonRec
+func nullableElems(elems []*Node, nullable map[*Node]bool) bool {
+	for _, elem := range elems {
+		if elem.left.op != OEPSILON && !nullable[elem.left] {
+			return false
+		}
 	}
+	return true
 }
 
-func removeIndirectRecursion(top *Node) {
+func hasEdge(edges map[*Node][]*Node, from *Node, to *Node) bool {
+	for _, e := range edges[from] {
+		if e == to {
+			return true
+		}
+	}
+	return false
 }
 
-func buildFirst(top *Node) {
+// components returns the strongly connected components of the graph of
+// rules, using Tarjan's algorithm. Each component lists its rules in the
+// order they were declared.
+func components(rules []*Node, edges map[*Node][]*Node) (comps [][]*Node) {
+	index := make(map[*Node]int)
+	low := make(map[*Node]int)
+	onStack := make(map[*Node]bool)
+	stack := make([]*Node, 0)
+	order := make(map[*Node]int)
+	for i, dcl := range rules {
+		order[dcl] = i
+	}
+
+	var visit func(v *Node)
+	visit = func(v *Node) {
+		index[v] = len(index) + 1
+		low[v] = index[v]
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range edges[v] {
+			switch {
+			case index[w] == 0:
+				visit(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			case onStack[w] && index[w] < low[v]:
+				low[v] = index[w]
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		comp := make([]*Node, 0)
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			comp = append(comp, w)
+			if w == v {
+				break
+			}
+		}
+		sort.Slice(comp, func(i, j int) bool {
+			return order[comp[i]] < order[comp[j]]
+		})
+		comps = append(comps, comp)
+	}
+	for _, dcl := range rules {
+		if index[dcl] == 0 {
+			visit(dcl)
+		}
+	}
+	return
+}
+
+func (c *compiler) buildFirst(top *Node) {
 	if top.op != OGRAM {
 		panic("buildFirst called on non OGRAM node")
 	}
@@ -144,7 +517,7 @@ func buildFirst(top *Node) {
 		if dcl.op != ORULE {
 			continue
 		}
-		first[dcl] = make(map[*Node]bool)
+		c.first[dcl] = make(map[*Node]bool)
 	}
 
 	anotherPass := true
@@ -162,26 +535,26 @@ func buildFirst(top *Node) {
 					e := elem.left
 					switch e.op {
 					case OEPSILON:
-						if !first[dcl][e] {
-							first[dcl][e] = true
+						if !c.first[dcl][e] {
+							c.first[dcl][e] = true
 							anotherPass = true
 						}
 
 					case OREGDEF, OSTRLIT:
-						if !first[dcl][e] {
-							first[dcl][e] = true
+						if !c.first[dcl][e] {
+							c.first[dcl][e] = true
 							anotherPass = true
 						}
 						continue productions
 
 					case ORULE:
-						for k, _ := range first[e] {
-							if !first[dcl][k] {
-								first[dcl][k] = true
+						for k, _ := range c.first[e] {
+							if !c.first[dcl][k] {
+								c.first[dcl][k] = true
 								anotherPass = true
 							}
 						}
-						if !first[e][nepsilon] {
+						if !c.first[e][nepsilon] {
 							continue productions
 						}
 
@@ -189,8 +562,8 @@ func buildFirst(top *Node) {
 						panic(fmt.Sprintf("unexpected op %s while building first", e.op))
 					}
 				}
-				if !first[dcl][nepsilon] {
-					first[dcl][nepsilon] = true
+				if !c.first[dcl][nepsilon] {
+					c.first[dcl][nepsilon] = true
 					anotherPass = true
 				}
 			}
@@ -199,7 +572,7 @@ func buildFirst(top *Node) {
 	return
 }
 
-func buildFollow(top *Node) {
+func (c *compiler) buildFollow(top *Node) {
 	if top.op != OGRAM {
 		panic("buildFirst called on non OGRAM node")
 	}
@@ -209,7 +582,7 @@ func buildFollow(top *Node) {
 		if dcl.op != ORULE {
 			continue
 		}
-		follow[dcl] = make(map[*Node]bool)
+		c.follow[dcl] = make(map[*Node]bool)
 	}
 
 	anotherPass := true
@@ -236,30 +609,30 @@ func buildFollow(top *Node) {
 					if next != nil {
 						switch next.op {
 						case OREGDEF, OSTRLIT:
-							if !follow[e][next] {
-								follow[e][next] = true
+							if !c.follow[e][next] {
+								c.follow[e][next] = true
 								anotherPass = true
 							}
 						case ORULE:
-							for k, _ := range first[next] {
+							for k, _ := range c.first[next] {
 								if k == nepsilon {
 									continue
 								}
-								if !follow[e][k] {
-									follow[e][k] = true
+								if !c.follow[e][k] {
+									c.follow[e][k] = true
 									anotherPass = true
 								}
 							}
 						case OEPSILON:
 						default:
-							panic(fmt.Sprintf("unexpected op %s found while building follow set\n", next))
+							panic(fmt.Sprintf("unexpected op %s found while building follow set\n", next.op))
 						}
 					}
 
-					if next == nil || next.op == OEPSILON || (next.op == ORULE && first[next][nepsilon]) {
-						for k, _ := range follow[dcl] {
-							if !follow[e][k] {
-								follow[e][k] = true
+					if next == nil || next.op == OEPSILON || (next.op == ORULE && c.first[next][nepsilon]) {
+						for k, _ := range c.follow[dcl] {
+							if !c.follow[e][k] {
+								c.follow[e][k] = true
 								anotherPass = true
 							}
 						}
@@ -301,21 +674,59 @@ func printSet(top *Node, name string, set *map[*Node]map[*Node]bool) {
 	w.Flush()
 }
 
-func printFirst(top *Node) {
-	printSet(top, "First", &first)
+func (c *compiler) printFirst(top *Node) {
+	printSet(top, "First", &c.first)
+}
+
+func (c *compiler) printFollow(top *Node) {
+	printSet(top, "Follow", &c.follow)
 }
 
-func printFollow(top *Node) {
-	printSet(top, "Follow", &follow)
+// An ll1Conflict is a pair of productions of a rule predicted by the
+// same lookahead tokens.
+type ll1Conflict struct {
+	prods  [2]*Node
+	follow [2]bool // whether the tokens come from the follow set
+	toks   []*Node
 }
 
-func ll1Check(top *Node) {
+func (c *compiler) ll1Check(top *Node) {
+	var wit *witness
 	for _, dcl := range top.nodes {
 		if dcl.op != ORULE {
 			continue
 		}
 
-		disjoint := make(map[*Node]bool)
+		// Each lookahead token predicts the production that claimed
+		// it first; a second claim is a conflict.
+		owner := make(map[*Node]*Node)
+		byFollow := make(map[*Node]bool)
+		conflicts := make([]*ll1Conflict, 0)
+		claim := func(prod *Node, toks map[*Node]bool, fromFollow bool) {
+			for _, k := range sortedToks(toks) {
+				o, ok := owner[k]
+				if !ok {
+					owner[k] = prod
+					byFollow[k] = fromFollow
+					continue
+				}
+				var cf *ll1Conflict
+				for _, c1 := range conflicts {
+					if c1.prods[0] == o && c1.prods[1] == prod {
+						cf = c1
+					}
+				}
+				if cf == nil {
+					cf = &ll1Conflict{
+						prods:  [2]*Node{o, prod},
+						follow: [2]bool{byFollow[k], fromFollow},
+					}
+					conflicts = append(conflicts, cf)
+				}
+				cf.toks = append(cf.toks, k)
+			}
+		}
+
 		followNotAdded := true
 		for _, prod := range dcl.nodes {
 			fst := prod.nodes[0].left
@@ -324,68 +735,354 @@ func ll1Check(top *Node) {
 			}
 			switch fst.op {
 			case OSTRLIT, OREGDEF:
-				if disjoint[fst] {
-					if dcl.orig != nil {
-						compileError(dcl.orig.pos, "%s is ambiguous", dcl.orig.sym)
-					} else {
-						compileError(dcl.pos, "%s is ambiguous", dcl.sym)
-					}
-				}
-				disjoint[fst] = true
+				claim(prod, map[*Node]bool{fst: true}, false)
 			case OEPSILON:
 				if followNotAdded {
-					for k, _ := range follow[dcl] {
-						if disjoint[k] {
-							if dcl.orig != nil {
-								compileError(dcl.orig.pos, "%s is ambiguous", dcl.orig.sym)
-							} else {
-								compileError(dcl.pos, "%s is ambiguous", dcl.sym)
-							}
-						}
-						disjoint[k] = true
-					}
+					claim(prod, c.follow[dcl], true)
 					followNotAdded = false
 				}
 			case ORULE:
-				if first[fst][nepsilon] && followNotAdded {
-					// Use follow[dcl]
-					for k, _ := range follow[dcl] {
-						if disjoint[k] {
-							if dcl.orig != nil {
-								compileError(dcl.orig.pos, "%s is ambiguous", dcl.orig.sym)
-							} else {
-								compileError(dcl.pos, "%s is ambiguous", dcl.sym)
-							}
-						}
-						disjoint[k] = true
-					}
+				if c.first[fst][nepsilon] && followNotAdded {
+					claim(prod, c.follow[dcl], true)
 					followNotAdded = false
 				} else {
-					// Use first[fst]
-					for k, _ := range first[fst] {
-						if disjoint[k] {
-							if dcl.orig != nil {
-								compileError(dcl.orig.pos, "%s is ambiguous", dcl.orig.sym)
-							} else {
-								compileError(dcl.pos, "%s is ambiguous", dcl.sym)
-							}
-						}
-						disjoint[k] = true
-					}
+					claim(prod, c.first[fst], false)
 				}
 			default:
 				panic(fmt.Sprintf("unexpected op %s in production\n", fst.op))
 			}
 		}
+
+		if len(conflicts) == 0 {
+			continue
+		}
+		if wit == nil {
+			wit = c.consWitness(top)
+		}
+		r := dcl.root()
+		for _, cf := range conflicts {
+			kind := "FIRST/FIRST"
+			a, b := cf.prods[0], cf.prods[1]
+			switch {
+			case cf.follow[0]:
+				kind = "FIRST/FOLLOW"
+				a, b = b, a
+			case cf.follow[1]:
+				kind = "FIRST/FOLLOW"
+			default:
+				// Left factoring does not keep the productions in
+				// order, name them as written
+				pa, pb := prodPos(a, r), prodPos(b, r)
+				if pb.line < pa.line || pb.line == pa.line && pb.col < pa.col {
+					a, b = b, a
+				}
+			}
+			toks := make([]string, 0, len(cf.toks))
+			for _, k := range cf.toks {
+				toks = append(toks, tokString(k))
+			}
+			example := wit.before(dcl, cf.toks[0])
+			if kind == "FIRST/FOLLOW" {
+				example = wit.after(dcl, cf.toks[0])
+			}
+			c.compileError(r.pos, "%s is ambiguous: %s conflict on %s between %s (%s) and %s (%s), as in %s",
+				r.sym, kind, strings.Join(toks, ", "),
+				prodString(a), prodPos(a, r), prodString(b), prodPos(b, r),
+				symsString(example)).
+				relate(prodPos(a, r), "production "+prodString(a)).
+				relate(prodPos(b, r), "production "+prodString(b))
+		}
 	}
 }
 
-func typeCheck(top *Node) {
+// sortedToks returns the tokens of set in a stable order.
+func sortedToks(set map[*Node]bool) []*Node {
+	toks := make([]*Node, 0, len(set))
+	for k := range set {
+		toks = append(toks, k)
+	}
+	sort.Slice(toks, func(i, j int) bool {
+		return tokString(toks[i]) < tokString(toks[j])
+	})
+	return toks
+}
+
+func tokString(k *Node) string {
+	switch k.op {
+	case OEPSILON:
+		return "the empty string"
+	case OSTRLIT:
+		return fmt.Sprintf("'%s'", escapeStrlit(k.lit.lit))
+	}
+	return k.sym.name
+}
+
+// prodString returns prod as written in a grammar, leaving out actions.
+func prodString(prod *Node) string {
+	syms := make([]*Node, 0, len(prod.nodes))
+	for _, elem := range prod.nodes {
+		if elem.left.op != OEPSILON && actionOf(elem.left) == nil {
+			syms = append(syms, elem.left)
+		}
+	}
+	if len(syms) == 0 {
+		return "/* epsilon */"
+	}
+	return symsString(syms)
+}
+
+func symsString(syms []*Node) string {
+	l := make([]string, 0, len(syms))
+	for _, s := range syms {
+		l = append(l, tokString(s))
+	}
+	return strings.Join(l, " ")
+}
+
+// prodPos returns where prod was written, or where its rule r was if
+// prod was made up by a transformation.
+func prodPos(prod *Node, r *Node) *Position {
+	if prod.pos != nil {
+		return prod.pos
+	}
+	return r.pos
+}
+
+// A witness builds the shortest inputs leading the parser into a rule,
+// from the shortest string of tokens each rule derives.
+type witness struct {
+	c      *compiler
+	top    *Node
+	yield  map[*Node][]*Node
+	prefix map[*Node][]*Node
+	follow map[*Node]map[*Node][]*Node
+}
+
+func (c *compiler) consWitness(top *Node) *witness {
+	w := &witness{
+		c:      c,
+		top:    top,
+		yield:  make(map[*Node][]*Node),
+		follow: make(map[*Node]map[*Node][]*Node),
+	}
+
+	// 1. Shortest string of tokens derived by each rule
+	for changed := true; changed; {
+		changed = false
+		for _, dcl := range top.nodes {
+			if dcl.op != ORULE {
+				continue
+			}
+			for _, prod := range dcl.nodes {
+				toks, ok := w.seqYield(prod.nodes)
+				if y, seen := w.yield[dcl]; ok && (!seen || len(toks) < len(y)) {
+					w.yield[dcl] = toks
+					changed = true
+				}
+			}
+		}
+	}
+
+	// 2. Shortest prefix read before each rule
+	w.prefix = w.prefixes(map[*Node][]*Node{top.left: nil}, nil)
+	return w
+}
+
+// seqYield returns the shortest string of tokens derived by elems.
+func (w *witness) seqYield(elems []*Node) (toks []*Node, ok bool) {
+	toks = make([]*Node, 0)
+	for _, elem := range elems {
+		e := elem.left
+		switch e.op {
+		case OEPSILON:
+		case ORULE:
+			y, ok := w.yield[e]
+			if !ok {
+				return nil, false
+			}
+			toks = append(toks, y...)
+		default:
+			toks = append(toks, e)
+		}
+	}
+	return toks, true
+}
+
+// prefixes extends the shortest prefixes in seed to every rule they lead
+// to. Given a token t, a rule is only entered where t can follow it.
+func (w *witness) prefixes(seed map[*Node][]*Node, t *Node) map[*Node][]*Node {
+	prefix := seed
+	for changed := true; changed; {
+		changed = false
+		for _, dcl := range w.top.nodes {
+			if dcl.op != ORULE {
+				continue
+			}
+			for _, prod := range dcl.nodes {
+				for i, elem := range prod.nodes {
+					if elem.left.op != ORULE {
+						continue
+					}
+					var p []*Node
+					var ok bool
+					if t == nil {
+						p, ok = prefix[dcl]
+					} else {
+						starts, nullable := w.c.seqStarts(prod.nodes[i+1:], t)
+						switch {
+						case starts:
+							p, ok = w.prefix[dcl]
+						case nullable:
+							p, ok = prefix[dcl]
+						}
+					}
+					if !ok {
+						continue
+					}
+					toks, ok := w.seqYield(prod.nodes[:i])
+					if !ok {
+						break
+					}
+					toks = append(append([]*Node{}, p...), toks...)
+					if p1, seen := prefix[elem.left]; !seen || len(toks) < len(p1) {
+						prefix[elem.left] = toks
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	return prefix
+}
+
+// seqStarts reports whether a string derived by elems can start with t,
+// and whether elems can derive the empty string.
+func (c *compiler) seqStarts(elems []*Node, t *Node) (starts bool, nullable bool) {
+	for _, elem := range elems {
+		e := elem.left
+		switch e.op {
+		case OEPSILON:
+		case ORULE:
+			if c.first[e][t] {
+				return true, false
+			}
+			if !c.first[e][nepsilon] {
+				return false, false
+			}
+		default:
+			return e == t, false
+		}
+	}
+	return false, true
+}
+
+// before returns the shortest input reaching dcl, followed by t.
+func (w *witness) before(dcl *Node, t *Node) []*Node {
+	return append(append([]*Node{}, w.prefix[dcl]...), t)
+}
+
+// after returns the shortest input reaching dcl where t can follow it,
+// followed by t.
+func (w *witness) after(dcl *Node, t *Node) []*Node {
+	if w.follow[t] == nil {
+		w.follow[t] = w.prefixes(make(map[*Node][]*Node), t)
+	}
+	p, ok := w.follow[t][dcl]
+	if !ok {
+		return w.before(dcl, t)
+	}
+	return append(append([]*Node{}, p...), t)
+}
+
+// dclType returns the Go type of the value carried by a production
+// element, and false if the element carries no value.
+func dclType(d *Node) (string, bool) {
+	e := d.left
+	switch e.op {
+	case ORULE:
+		if actionOf(e) != nil || e.ntype == nil {
+			return "", false
+		}
+		return e.ntype.typ, true
+	case OREGDEF:
+		if e.ntype != nil {
+			return e.ntype.typ, true
+		}
+		return "string", true
+	case OSTRLIT:
+		return "string", true
+	}
+	return "", false
+}
+
+// actionCheck makes sure every variable id used in an action refers to an
+// element with a value, and that every typed regdef can be converted
+// from the text of its token.
+func (c *compiler) actionCheck(top *Node) {
+	for _, dcl := range top.nodes {
+		switch dcl.op {
+		case OREGDEF:
+			if dcl.ntype == nil {
+				continue
+			}
+			if _, ok := tokenConv[dcl.ntype.typ]; !ok {
+				c.compileError(dcl.pos, "no conversion from token text to type %s", dcl.ntype.typ)
+			}
+		case ORULE:
+			a := actionOf(dcl)
+			if a == nil {
+				continue
+			}
+			seen := make(map[*Node]bool)
+			for _, d := range a.dpn {
+				if _, ok := dclType(d); ok || seen[d] {
+					continue
+				}
+				seen[d] = true
+				switch {
+				case d.left.op == OEPSILON:
+					c.compileError(a.pos, "%s refers to an empty element, which has no value", d.sym)
+				case actionOf(d.left) != nil:
+					c.compileError(a.pos, "%s refers to an action, which has no value", d.sym)
+				default:
+					c.compileError(a.pos, "%s refers to %s, which has no type", d.sym, d.left.sym)
+				}
+			}
+		}
+	}
+}
+
+func (c *compiler) typeCheck(top *Node) {
+	// 0. Check the values flowing through actions before the
+	// transformations below move them around.
+	c.actionCheck(top)
+
+	// The LALR(1) and Earley backends take the grammar as written
+	switch c.backend {
+	case "lalr":
+		if opt['p'] {
+			pprint(top)
+		}
+		c.lalrtab = c.buildLALR(top)
+		return
+	case "earley":
+		if opt['p'] {
+			pprint(top)
+		}
+		c.earleytab = lrGrammar(top)
+		return
+	}
+
 	// 1. Perform transformation of the grammar, aiding the user
-	// in writing a LL(1) language.
-	leftFactor(top)
-	removeDirectRecursion(top)
-	//removeIndirectRecursion(top)
+	// in writing a LL(1) language. Left recursion that cannot be
+	// removed leaves nothing worth transforming further.
+	nerrs := c.numTotalErrs
+	c.removeIndirectRecursion(top)
+	if c.numTotalErrs > nerrs {
+		return
+	}
+	c.leftFactor(top)
+	c.removeDirectRecursion(top)
 
 	if opt['p'] {
 		pprint(top)
@@ -393,16 +1090,16 @@ func typeCheck(top *Node) {
 
 	// 2. Create first and follow sets to analyze the transformed
 	// grammar.
-	buildFirst(top)
-	buildFollow(top)
+	c.buildFirst(top)
+	c.buildFollow(top)
 
 	if opt['g'] {
-		printFirst(top)
-		printFollow(top)
+		c.printFirst(top)
+		c.printFollow(top)
 	}
 
 	// 3. Check for LL(1) grammar
-	ll1Check(top)
+	c.ll1Check(top)
 
 	if opt['1'] {
 		top.dumpTree()